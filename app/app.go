@@ -2,6 +2,8 @@ package main
 
 import (
 	"log"
+	"strconv"
+	"time"
 
 	"github.com/jostillmanns/tokenshare"
 
@@ -10,7 +12,21 @@ import (
 
 var (
 	butCreate *dom.HTMLButtonElement
+	butShare  *dom.HTMLButtonElement
 	divTokens *dom.HTMLDivElement
+	divShare  *dom.HTMLDivElement
+	divUsage  *dom.HTMLDivElement
+	inpTTL    *dom.HTMLInputElement
+	inpFiles  *dom.HTMLInputElement
+	inpBytes  *dom.HTMLInputElement
+	inpSize   *dom.HTMLInputElement
+	inpDown   *dom.HTMLInputElement
+
+	inpLabel     *dom.HTMLInputElement
+	inpRecipient *dom.HTMLInputElement
+	inpNote      *dom.HTMLTextAreaElement
+	inpShowNote  *dom.HTMLInputElement
+	inpPass      *dom.HTMLInputElement
 )
 
 func main() {
@@ -18,13 +34,66 @@ func main() {
 
 	butCreate = d.GetElementByID("create").(*dom.HTMLButtonElement)
 	divTokens = d.GetElementByID("tokens").(*dom.HTMLDivElement)
+	butShare = d.GetElementByID("share").(*dom.HTMLButtonElement)
+	divShare = d.GetElementByID("share-progress").(*dom.HTMLDivElement)
+	divUsage = d.GetElementByID("usage").(*dom.HTMLDivElement)
+	inpTTL = d.GetElementByID("ttl").(*dom.HTMLInputElement)
+	inpFiles = d.GetElementByID("max-files").(*dom.HTMLInputElement)
+	inpBytes = d.GetElementByID("max-bytes").(*dom.HTMLInputElement)
+	inpSize = d.GetElementByID("max-size").(*dom.HTMLInputElement)
+	inpDown = d.GetElementByID("max-downloads").(*dom.HTMLInputElement)
+	inpLabel = d.GetElementByID("label").(*dom.HTMLInputElement)
+	inpRecipient = d.GetElementByID("recipient").(*dom.HTMLInputElement)
+	inpNote = d.GetElementByID("note").(*dom.HTMLTextAreaElement)
+	inpShowNote = d.GetElementByID("show-note").(*dom.HTMLInputElement)
+	inpPass = d.GetElementByID("passphrase").(*dom.HTMLInputElement)
 
 	var client tokenshare.Client
 
 	butCreate.AddEventListener("click", false, func(event dom.Event) {
 		go func() {
-			if err := client.Create(divTokens); err != nil {
+			opts, err := options()
+			if err != nil {
 				log.Printf("create: %v", err)
+				return
+			}
+
+			if err := client.Create(divTokens, opts); err != nil {
+				log.Printf("create: %v", err)
+			}
+		}()
+	})
+
+	openResult := &tokenshare.OpenResult{}
+
+	input := d.GetElementByID("share-input").(*dom.HTMLInputElement)
+	input.AddEventListener("change", false, func(_ dom.Event) {
+		go func() {
+			client.Open(input, openResult)
+			butShare.Disabled = false
+		}()
+	})
+
+	butShare.AddEventListener("click", false, func(event dom.Event) {
+		go func() {
+			res := openResult.Get()
+			if res.Name == "" {
+				log.Println("file not loaded")
+				return
+			}
+
+			opts, err := options()
+			if err != nil {
+				log.Printf("share: %v", err)
+				return
+			}
+
+			if err := client.Share(res.Data, res.Name, opts, divTokens, divShare); err != nil {
+				log.Printf("share: %v", err)
+			}
+
+			if err := client.Usage(divUsage); err != nil {
+				log.Printf("usage: %v", err)
 			}
 		}()
 	})
@@ -33,5 +102,62 @@ func main() {
 		if err := client.List(divTokens); err != nil {
 			log.Printf("list: %v", err)
 		}
+
+		if err := client.Usage(divUsage); err != nil {
+			log.Printf("usage: %v", err)
+		}
 	}()
 }
+
+func options() (tokenshare.CreateOptions, error) {
+	opts := tokenshare.CreateOptions{
+		Label:     inpLabel.Value,
+		Recipient: inpRecipient.Value,
+		Note:      inpNote.Value,
+		ShowNote:  inpShowNote.Checked,
+
+		Passphrase: inpPass.Value,
+	}
+
+	if inpTTL.Value != "" {
+		ttl, err := time.ParseDuration(inpTTL.Value)
+		if err != nil {
+			return opts, err
+		}
+		opts.TTL = ttl
+	}
+
+	if inpFiles.Value != "" {
+		n, err := strconv.Atoi(inpFiles.Value)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxFiles = n
+	}
+
+	if inpBytes.Value != "" {
+		n, err := strconv.ParseInt(inpBytes.Value, 10, 64)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxBytes = n
+	}
+
+	if inpSize.Value != "" {
+		n, err := strconv.ParseInt(inpSize.Value, 10, 64)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxSize = n
+	}
+
+	if inpDown.Value != "" {
+		n, err := strconv.Atoi(inpDown.Value)
+		if err != nil {
+			return opts, err
+		}
+		opts.MaxDownloads = n
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+// archiver writes the files of a token into a single archive stream.
+type archiver interface {
+	add(name string, size int64, t time.Time, rdr io.Reader) error
+	Close() error
+}
+
+type zipArchiver struct {
+	zw *zip.Writer
+}
+
+func (a zipArchiver) add(name string, size int64, t time.Time, rdr io.Reader) error {
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: t})
+	if err != nil {
+		return err
+	}
+
+	// unlike tar, zip does not know the size up front to catch a short file
+	n, err := io.Copy(w, rdr)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (a zipArchiver) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchiver struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a tarArchiver) add(name string, size int64, t time.Time, rdr io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: size, ModTime: t, Typeflag: tar.TypeReg}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(a.tw, rdr)
+	return err
+}
+
+func (a tarArchiver) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	return a.gz.Close()
+}
+
+func newArchiver(format tokenshare.Archive, w io.Writer) (archiver, string, bool) {
+	switch format {
+	case tokenshare.ArchiveZip:
+		return zipArchiver{zip.NewWriter(w)}, "application/zip", true
+	case tokenshare.ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		return tarArchiver{gz, tar.NewWriter(gz)}, "application/gzip", true
+	}
+
+	return nil, "", false
+}
+
+// archive serves all files of the token as one archive, generated while it
+// is sent. A manifest with the size and checksum of every file is added
+// last, the checksums are computed from the bytes written to the archive.
+func (s *server) archive(w http.ResponseWriter, tok tokenshare.Token, bid []byte, format tokenshare.Archive) {
+	if _, _, ok := newArchiver(format, nil); !ok {
+		http.Error(w, fmt.Sprintf("unknown %s: %s", tokenshare.Format, format), http.StatusBadRequest)
+		return
+	}
+
+	if len(tok.Files) == 0 {
+		http.Error(w, "token holds no files", http.StatusNotFound)
+		return
+	}
+
+	// all files are opened before the download is counted, see download
+	files := make([]object, 0, len(tok.Files))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, info := range tok.Files {
+		key, dataKey, err := s.locate(tok, info)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, fmt.Sprintf("data key: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		var f object
+		if err == nil {
+			f, err = s.openFile(key, dataKey)
+		}
+		if errors.Is(err, fs.ErrNotExist) && tok.Exhausted() {
+			http.Error(w, tokenshare.DownloadLimit{}.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("open: %v", err), http.StatusInternalServerError)
+			return
+		}
+		files = append(files, f)
+	}
+
+	infos := tok.Files
+	tok, err := s.count(bid)
+	if err != nil {
+		http.Error(w, err.Error(), code(err))
+		return
+	}
+
+	// the files are only released once the archive went out in full
+	sent := false
+	defer func() {
+		if !sent || !tok.Exhausted() {
+			return
+		}
+
+		if err := s.release(bid); err != nil {
+			log.Printf("purge %s: %v", tok.Key(), err)
+		}
+	}()
+
+	a, contentType, _ := newArchiver(format, w)
+	w.Header().Set("content-type", contentType)
+	w.Header().Set("content-disposition", disposition(tok.Key()+"."+string(format)))
+
+	// the response has started, errors can only be logged from here on
+	manifest := make([]tokenshare.ManifestEntry, len(files))
+	for i, f := range files {
+		info := infos[i]
+
+		var rdr io.Reader = f
+		if info.Encoding != "" {
+			dec, err := newDecoder(info.Encoding, f)
+			if err != nil {
+				log.Printf("archive %s: %v", tok.Key(), err)
+				return
+			}
+			defer dec.Close()
+			rdr = dec
+		}
+
+		h := sha256.New()
+		if err := a.add(info.Name, info.Size, info.T, io.TeeReader(rdr, h)); err != nil {
+			log.Printf("archive %s: %v", tok.Key(), err)
+			return
+		}
+
+		manifest[i] = tokenshare.ManifestEntry{Name: info.Name, Size: info.Size, SHA256: hex.EncodeToString(h.Sum(nil))}
+	}
+
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Printf("archive %s: %v", tok.Key(), err)
+		return
+	}
+
+	if err := a.add(tokenshare.ManifestName, int64(len(buf)), time.Now(), bytes.NewReader(buf)); err != nil {
+		log.Printf("archive %s: %v", tok.Key(), err)
+		return
+	}
+
+	if err := a.Close(); err != nil {
+		log.Printf("archive %s: %v", tok.Key(), err)
+		return
+	}
+
+	err = http.NewResponseController(w).Flush()
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Printf("archive %s: %v", tok.Key(), err)
+		return
+	}
+
+	sent = true
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+
+	"github.com/boltdb/bolt"
+	"github.com/jostillmanns/tokenshare"
+)
+
+// With deduplication enabled, files are stored once per content below the
+// blob directory, keyed by their SHA-256. A record in the blobs bucket
+// counts the files referencing a blob, and the blob is removed with its
+// last reference. The references are changed in the transaction that
+// changes the files of the token, under the blob lock of the server, so a
+// blob is never removed while another upload starts to reference it. New
+// blobs are moved to their place under the same lock, before the
+// transaction.
+//
+// Files stored before, or without deduplication, have no blob and are
+// kept in the directory of their token.
+const blobDir = ".blobs"
+
+// blob is the record of a stored blob. The data key of an encrypted blob
+// is its own, wrapped with the digest, as blobs are shared by tokens.
+type blob struct {
+	Refs     int    `json:"refs"`
+	Encoding string `json:"encoding,omitempty"`
+	DataKey  []byte `json:"data_key,omitempty"`
+	KeyID    string `json:"key_id,omitempty"`
+}
+
+func blobKey(sum string) string {
+	return path.Join(blobDir, sum)
+}
+
+// blobRefs are the blob records within a transaction.
+type blobRefs struct {
+	bucket *bolt.Bucket
+	// released are the blobs that lost their last reference.
+	released []string
+}
+
+func (r *blobRefs) get(sum string) (blob, bool, error) {
+	var b blob
+
+	d := r.bucket.Get([]byte(sum))
+	if d == nil {
+		return b, false, nil
+	}
+
+	err := json.Unmarshal(d, &b)
+	return b, true, err
+}
+
+func (r *blobRefs) put(sum string, b blob) error {
+	d, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	return r.bucket.Put([]byte(sum), d)
+}
+
+// unref drops a reference to blob sum, the record is removed with the
+// last one.
+func (r *blobRefs) unref(sum string) error {
+	b, ok, err := r.get(sum)
+	if err != nil || !ok {
+		return err
+	}
+
+	b.Refs--
+	if b.Refs > 0 {
+		return r.put(sum, b)
+	}
+
+	r.released = append(r.released, sum)
+	return r.bucket.Delete([]byte(sum))
+}
+
+// modifyRefs is modify for changes to the blob references of token bid.
+// Blobs that lost their last reference are removed once the change is
+// committed.
+func (s *server) modifyRefs(bid []byte, fn func(*tokenshare.Token, *blobRefs) error) (tokenshare.Token, error) {
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	return s.applyRefs(bid, fn)
+}
+
+// applyRefs is modifyRefs for callers holding the blob lock.
+func (s *server) applyRefs(bid []byte, fn func(*tokenshare.Token, *blobRefs) error) (tokenshare.Token, error) {
+	tok, released, err := s.database.modifyRefs(bid, fn)
+	for _, sum := range released {
+		if err := s.files.remove(blobKey(sum)); err != nil {
+			log.Printf("remove blob %s: %v", sum, err)
+		}
+	}
+
+	return tok, err
+}
+
+// fileKey returns the key a new file of token bid is encrypted with, nil
+// if no master keys are configured. With deduplication every file gets a
+// key of its own, otherwise the data key of the token is used.
+func (s *server) fileKey(bid []byte) ([]byte, error) {
+	if !s.dedup || s.keys == nil {
+		return s.dataKey(bid)
+	}
+
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// record adds info, written to the temporary object tmp with dataKey, to
+// token bid and moves the object to its place. prepare is applied to the
+// token first, if it is not nil. A file the new one replaces is released.
+//
+// Objects are not moved within the transaction, which would hold up all
+// other changes to the database while the storage copies them. A new blob
+// is moved before, and removed again if the file cannot be recorded. A
+// file of the token directory is moved after, the record is reverted if
+// that fails.
+func (s *server) record(bid []byte, tmp string, info tokenshare.FileInfo, dataKey []byte, prepare func(*tokenshare.Token)) (tokenshare.Token, error) {
+	id := hex.EncodeToString(bid)
+
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+
+	// the quotas are checked again, concurrent uploads to other tokens
+	// might have claimed the space in the meantime. The other tokens are
+	// counted before the transaction, files are only recorded under the
+	// blob lock.
+	var all, owned int64
+	if s.quota > 0 || s.adminQuota > 0 {
+		tok, _, err := s.poke(bid)
+		if err == nil {
+			all, owned, err = s.usageWithout(bid, s.owner(tok))
+		}
+		if err != nil {
+			return tokenshare.Token{}, err
+		}
+	}
+
+	// the references only change under the blob lock, the blob stays
+	// unknown to other uploads until it is recorded
+	var placed bool
+	if s.dedup {
+		_, known, err := s.database.blob(info.SHA256)
+		if err != nil {
+			return tokenshare.Token{}, err
+		}
+
+		if !known {
+			if err := s.files.rename(tmp, blobKey(info.SHA256)); err != nil {
+				return tokenshare.Token{}, err
+			}
+			placed = true
+		}
+	}
+
+	var legacy bool
+	var duplicate bool
+	var prev tokenshare.FileInfo
+	var replaced bool
+	var status tokenshare.Status
+	tok, err := s.applyRefs(bid, func(t *tokenshare.Token, refs *blobRefs) error {
+		before := held(*t)
+		status = t.State()
+		if prepare != nil {
+			prepare(t)
+		}
+
+		prev, replaced = t.File(info.Name)
+
+		var b blob
+		if s.dedup {
+			var err error
+			if b, duplicate, err = refs.get(info.SHA256); err != nil {
+				return err
+			}
+
+			// a duplicate is stored as the blob was
+			if duplicate {
+				info.Encoding, info.Encrypted = b.Encoding, len(b.DataKey) > 0
+			}
+			info.Blob = info.SHA256
+		}
+
+		if err := t.Add(info); err != nil {
+			return err
+		}
+
+		if err := finish(t); err != nil {
+			return err
+		}
+
+		if held(*t) > before {
+			if err := s.fits(*t, all, owned); err != nil {
+				return err
+			}
+		}
+
+		if duplicate {
+			b.Refs++
+			if err := refs.put(info.SHA256, b); err != nil {
+				return err
+			}
+		} else if s.dedup {
+			if err := s.link(refs, info, dataKey); err != nil {
+				return err
+			}
+		}
+
+		// the reference is dropped last, the file might be replaced by
+		// the same content
+		legacy = replaced && prev.Blob == "" && s.dedup
+		if replaced && prev.Blob != "" {
+			return refs.unref(prev.Blob)
+		}
+
+		return nil
+	})
+	if err != nil {
+		if placed {
+			_ = s.files.remove(blobKey(info.SHA256))
+		}
+		return tok, err
+	}
+
+	if !s.dedup {
+		if err := s.place(tmp, id, info.Name); err != nil {
+			s.unrecord(bid, info, prev, replaced, status)
+			return tok, err
+		}
+	}
+
+	if duplicate {
+		_ = s.files.remove(tmp)
+	}
+
+	// the replaced file was stored in the token directory
+	if legacy {
+		if err := s.files.remove(path.Join(id, info.Name)); err != nil {
+			log.Printf("remove %s: %v", info.Name, err)
+		}
+	}
+
+	return tok, nil
+}
+
+// unrecord reverts the record of info to token bid, whose object could not
+// be moved to its place. prev is the file info replaced, and status the
+// state of the token before.
+func (s *server) unrecord(bid []byte, info tokenshare.FileInfo, prev tokenshare.FileInfo, replaced bool, status tokenshare.Status) {
+	_, err := s.modify(bid, func(t *tokenshare.Token) error {
+		files := make([]tokenshare.FileInfo, 0, len(t.Files))
+		for _, f := range t.Files {
+			if f.Name != info.Name {
+				files = append(files, f)
+			} else if replaced {
+				files = append(files, prev)
+			}
+		}
+		t.Files = files
+
+		// the token was finished with the file, unless it moved on since
+		if st := t.State(); st != status && (st == tokenshare.StatusComplete || st == tokenshare.StatusUploading) {
+			t.Status = status
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Printf("revert %s: %v", info.Name, err)
+	}
+}
+
+// link records the new blob of info, its data key is wrapped with the
+// digest.
+func (s *server) link(refs *blobRefs, info tokenshare.FileInfo, dataKey []byte) error {
+	b := blob{Refs: 1, Encoding: info.Encoding}
+	if dataKey != nil {
+		var err error
+		if b.DataKey, b.KeyID, err = s.keys.wrap([]byte(info.SHA256), dataKey); err != nil {
+			return err
+		}
+	}
+
+	return refs.put(info.SHA256, b)
+}
+
+// locate returns the key of the stored file info of tok and the key it is
+// decrypted with.
+func (s *server) locate(tok tokenshare.Token, info tokenshare.FileInfo) (string, []byte, error) {
+	if info.Blob == "" {
+		dataKey, err := s.tokenKey(tok, info.Encrypted)
+		return path.Join(hex.EncodeToString(tok.ID), info.Name), dataKey, err
+	}
+
+	if !info.Encrypted {
+		return blobKey(info.Blob), nil, nil
+	}
+
+	if s.keys == nil {
+		return "", nil, errors.New("file is encrypted, but no master keys are configured")
+	}
+
+	b, ok, err := s.database.blob(info.Blob)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("blob %s: %w", info.Blob, fs.ErrNotExist)
+	}
+
+	dataKey, err := s.keys.unwrapKey([]byte(info.Blob), b.KeyID, b.DataKey)
+	return blobKey(info.Blob), dataKey, err
+}
+
+// release removes the files stored in the directory of token bid and drops
+// the references of all its other files. The files stay listed.
+func (s *server) release(bid []byte) error {
+	if err := s.files.removeAll(hex.EncodeToString(bid)); err != nil {
+		return err
+	}
+
+	_, err := s.modifyRefs(bid, func(t *tokenshare.Token, refs *blobRefs) error {
+		for i, f := range t.Files {
+			if f.Blob == "" {
+				continue
+			}
+
+			if err := refs.unref(f.Blob); err != nil {
+				return err
+			}
+			t.Files[i].Blob = ""
+		}
+
+		return nil
+	})
+
+	return err
+}
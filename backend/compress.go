@@ -0,0 +1,175 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jostillmanns/tokenshare"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Files may be stored compressed, the encoding names match the tokens of
+// the Accept-Encoding header.
+const (
+	encGzip = "gzip"
+	encZstd = "zstd"
+)
+
+// incompressible lists extensions of formats that are compressed already
+// and are thus stored as they are.
+var incompressible = map[string]bool{
+	".gz": true, ".tgz": true, ".zip": true, ".7z": true, ".rar": true,
+	".xz": true, ".bz2": true, ".zst": true, ".br": true, ".lz4": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".heic": true, ".mp3": true, ".mp4": true, ".m4a": true, ".mkv": true,
+	".mov": true, ".webm": true, ".ogg": true, ".flac": true, ".pdf": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".odt": true, ".ods": true,
+}
+
+// checkEncoding reports an error unless enc is empty or a supported
+// encoding.
+func checkEncoding(enc string) error {
+	switch enc {
+	case "", encGzip, encZstd:
+		return nil
+	}
+
+	return fmt.Errorf("unknown encoding: %s", enc)
+}
+
+// encoding returns how the file name is stored, the configured compression
+// unless the file is compressed already or encrypted by its sender, as
+// ciphertext does not compress.
+func (s *server) encoding(name string, e2e *tokenshare.E2E) string {
+	if e2e != nil || incompressible[strings.ToLower(filepath.Ext(name))] {
+		return ""
+	}
+
+	return s.compress
+}
+
+func newEncoder(enc string, w io.Writer) (io.WriteCloser, error) {
+	switch enc {
+	case encGzip:
+		return gzip.NewWriter(w), nil
+	case encZstd:
+		return zstd.NewWriter(w)
+	}
+
+	return nil, fmt.Errorf("unknown encoding: %s", enc)
+}
+
+func newDecoder(enc string, r io.Reader) (io.ReadCloser, error) {
+	switch enc {
+	case encGzip:
+		return gzip.NewReader(r)
+	case encZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("unknown encoding: %s", enc)
+}
+
+// decoded reads a compressed file as if it was stored plainly. Seeking is
+// emulated by decoding from the start of the file, which is good enough
+// for the few seeks of http.ServeContent.
+type decoded struct {
+	f    io.ReadSeeker
+	enc  string
+	size int64
+
+	r   io.ReadCloser
+	pos int64 // offset of r in the decoded file
+	off int64 // offset requested by Seek
+}
+
+func (d *decoded) Read(p []byte) (int, error) {
+	if d.r == nil || d.off < d.pos {
+		if d.r != nil {
+			d.r.Close()
+		}
+
+		if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+
+		r, err := newDecoder(d.enc, d.f)
+		if err != nil {
+			return 0, err
+		}
+		d.r, d.pos = r, 0
+	}
+
+	if d.off > d.pos {
+		n, err := io.CopyN(ioutil.Discard, d.r, d.off-d.pos)
+		d.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := d.r.Read(p)
+	d.pos += int64(n)
+	d.off = d.pos
+	return n, err
+}
+
+func (d *decoded) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += d.off
+	case io.SeekEnd:
+		offset += d.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+
+	d.off = offset
+	return offset, nil
+}
+
+func (d *decoded) Close() error {
+	if d.r == nil {
+		return nil
+	}
+
+	return d.r.Close()
+}
+
+// accepts reports whether the Accept-Encoding header of a request lists
+// enc with a non-zero quality.
+func accepts(header, enc string) bool {
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), enc) {
+			continue
+		}
+
+		for _, param := range fields[1:] {
+			q := strings.TrimSpace(param)
+			if !strings.HasPrefix(q, "q=") {
+				continue
+			}
+
+			if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
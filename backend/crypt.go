@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jostillmanns/tokenshare"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Files are encrypted with a data key of their token, which is stored in
+// the token record wrapped with a master key. Rotating the master key thus
+// only rewraps the data keys, the files are left as they are.
+//
+// An encrypted file starts with a version byte and a random salt, from
+// which and the data key the key of the file is derived. The file is
+// sealed with AES-GCM in chunks of sealChunk bytes, each with a nonce of
+// its index and a flag marking the last chunk, so chunks can neither be
+// reordered nor cut off, and every chunk can be read on its own.
+const (
+	sealVersion = 1
+	sealSalt    = 32
+	sealHeader  = 1 + sealSalt
+	sealChunk   = 64 * 1024
+)
+
+// keyring holds the master keys, data keys are wrapped with the current
+// one and unwrapped with the one they were wrapped with.
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// loadKeyring reads master keys from path, one per line as an id and the
+// base64 encoded 32 byte key, separated by a space. The first key is the
+// current one. Empty lines and lines starting with # are skipped.
+func loadKeyring(path string) (*keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want id and key", path, line)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%s:%d: key must be 32 bytes, base64 encoded", path, line)
+		}
+
+		if err := k.add(fields[0], key); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if k.current == "" {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	return k, nil
+}
+
+// add adds a master key, the first one added is the current one.
+func (k *keyring) add(id string, key []byte) error {
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("duplicate key %s", id)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	if k.current == "" {
+		k.current = id
+	}
+	k.keys[id] = aead
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// wrap encrypts the data key of token id with the current master key and
+// returns the result and the id of the master key.
+func (k *keyring) wrap(id, dataKey []byte) ([]byte, string, error) {
+	aead := k.keys[k.current]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+
+	return aead.Seal(nonce, nonce, dataKey, id), k.current, nil
+}
+
+// unwrap returns the data key of tok.
+func (k *keyring) unwrap(tok tokenshare.Token) ([]byte, error) {
+	return k.unwrapKey(tok.ID, tok.KeyID, tok.DataKey)
+}
+
+// unwrapKey returns the data key wrapped for id with master key kid.
+func (k *keyring) unwrapKey(id []byte, kid string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", kid)
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid data key")
+	}
+
+	n := aead.NonceSize()
+	return aead.Open(nil, wrapped[:n], wrapped[n:], id)
+}
+
+// dataKey returns the key new files of token bid are encrypted with,
+// which is created with the first file. It is nil if no master keys are
+// configured.
+func (s *server) dataKey(bid []byte) ([]byte, error) {
+	if s.keys == nil {
+		return nil, nil
+	}
+
+	var key []byte
+	_, err := s.modify(bid, func(t *tokenshare.Token) error {
+		if len(t.DataKey) > 0 {
+			k, err := s.keys.unwrap(*t)
+			key = k
+			return err
+		}
+
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+
+		wrapped, id, err := s.keys.wrap(t.ID, key)
+		t.DataKey, t.KeyID = wrapped, id
+		return err
+	})
+
+	return key, err
+}
+
+// tokenKey returns the key the files of tok are decrypted with, nil if
+// encrypted is not set.
+func (s *server) tokenKey(tok tokenshare.Token, encrypted bool) ([]byte, error) {
+	if !encrypted {
+		return nil, nil
+	}
+
+	if s.keys == nil {
+		return nil, errors.New("file is encrypted, but no master keys are configured")
+	}
+
+	return s.keys.unwrap(tok)
+}
+
+// rewrap wraps the data keys of all tokens and blobs with the current master key
+// and returns the number of keys rewrapped. Keys that were rotated out
+// are not needed anymore once it returns.
+func (s *server) rewrap() (int, error) {
+	toks, err := s.database.list()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, tok := range toks {
+		if len(tok.DataKey) == 0 || tok.KeyID == s.keys.current {
+			continue
+		}
+
+		if _, err := s.modify(tok.ID, func(t *tokenshare.Token) error {
+			key, err := s.keys.unwrap(*t)
+			if err != nil {
+				return err
+			}
+
+			t.DataKey, t.KeyID, err = s.keys.wrap(t.ID, key)
+			return err
+		}); err != nil {
+			log.Printf("rewrap %x: %v", tok.ID, err)
+			continue
+		}
+		n++
+	}
+
+	err = s.database.modifyBlobs(func(sum string, b *blob) (bool, error) {
+		if len(b.DataKey) == 0 || b.KeyID == s.keys.current {
+			return false, nil
+		}
+
+		key, err := s.keys.unwrapKey([]byte(sum), b.KeyID, b.DataKey)
+		if err != nil {
+			log.Printf("rewrap blob %s: %v", sum, err)
+			return false, nil
+		}
+
+		if b.DataKey, b.KeyID, err = s.keys.wrap([]byte(sum), key); err != nil {
+			return false, err
+		}
+		n++
+		return true, nil
+	})
+
+	return n, err
+}
+
+// createFile starts writing the object key, encrypted with dataKey if it
+// is not nil.
+func (s *server) createFile(key string, dataKey []byte) (writer, error) {
+	w, err := s.files.create(key)
+	if err != nil || dataKey == nil {
+		return w, err
+	}
+
+	sw, err := newSealer(w, dataKey)
+	if err != nil {
+		w.abort()
+		return nil, err
+	}
+
+	return sealWriter{w, sw}, nil
+}
+
+// openFile opens the object key, decrypted with dataKey if it is not nil.
+func (s *server) openFile(key string, dataKey []byte) (object, error) {
+	f, err := s.files.open(key)
+	if err != nil || dataKey == nil {
+		return f, err
+	}
+
+	o, err := openSealed(f, dataKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// fileAEAD derives the cipher of a file from the data key and its salt.
+func fileAEAD(dataKey, salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dataKey, salt, []byte("tokenshare file")), key); err != nil {
+		return nil, err
+	}
+
+	return newGCM(key)
+}
+
+func chunkNonce(aead cipher.AEAD, i uint64, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+
+	return nonce
+}
+
+// sealer encrypts the bytes written to it. A chunk is only sealed once
+// more bytes follow or the sealer is closed, the last chunk is marked.
+type sealer struct {
+	w    io.Writer
+	aead cipher.AEAD
+	buf  []byte
+	out  []byte
+	i    uint64
+}
+
+func newSealer(w io.Writer, dataKey []byte) (*sealer, error) {
+	header := make([]byte, sealHeader)
+	header[0] = sealVersion
+	if _, err := rand.Read(header[1:]); err != nil {
+		return nil, err
+	}
+
+	aead, err := fileAEAD(dataKey, header[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &sealer{w: w, aead: aead, buf: make([]byte, 0, sealChunk)}, nil
+}
+
+func (s *sealer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(s.buf) == sealChunk {
+			if err := s.flush(false); err != nil {
+				return n - len(p), err
+			}
+		}
+
+		room := sealChunk - len(s.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		s.buf = append(s.buf, p[:room]...)
+		p = p[room:]
+	}
+
+	return n, nil
+}
+
+func (s *sealer) flush(last bool) error {
+	s.out = s.aead.Seal(s.out[:0], chunkNonce(s.aead, s.i, last), s.buf, nil)
+	s.buf = s.buf[:0]
+	s.i++
+
+	_, err := s.w.Write(s.out)
+	return err
+}
+
+// Close seals the last chunk, it does not close the underlying writer.
+func (s *sealer) Close() error {
+	return s.flush(true)
+}
+
+// sealWriter is a writer of a driver that encrypts what is written.
+type sealWriter struct {
+	writer
+	s *sealer
+}
+
+func (w sealWriter) Write(p []byte) (int, error) {
+	return w.s.Write(p)
+}
+
+func (w sealWriter) commit() error {
+	if err := w.s.Close(); err != nil {
+		w.abort()
+		return err
+	}
+
+	return w.writer.commit()
+}
+
+// sealed reads an encrypted object. Every read decrypts the chunk it falls
+// into, so seeking is cheap.
+type sealed struct {
+	f      object
+	aead   cipher.AEAD
+	chunks int64
+	len    int64
+
+	off   int64
+	i     int64 // index of the chunk in plain, -1 if none
+	plain []byte
+	buf   []byte
+}
+
+func openSealed(f object, dataKey []byte) (*sealed, error) {
+	header := make([]byte, sealHeader)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return nil, fmt.Errorf("read header: %v", err)
+	}
+
+	if header[0] != sealVersion {
+		return nil, fmt.Errorf("unknown encryption version %d", header[0])
+	}
+
+	aead, err := fileAEAD(dataKey, header[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// every chunk carries a tag, the last one is shorter or even empty
+	full := int64(sealChunk + aead.Overhead())
+	n := f.size() - sealHeader
+	chunks := (n + full - 1) / full
+	last := n - (chunks-1)*full
+	if chunks == 0 || last < int64(aead.Overhead()) {
+		return nil, errors.New("encrypted file is truncated")
+	}
+
+	return &sealed{
+		f:      f,
+		aead:   aead,
+		chunks: chunks,
+		len:    (chunks-1)*sealChunk + last - int64(aead.Overhead()),
+		i:      -1,
+	}, nil
+}
+
+func (s *sealed) Read(p []byte) (int, error) {
+	if s.off >= s.len {
+		return 0, io.EOF
+	}
+
+	i := s.off / sealChunk
+	if i != s.i {
+		if err := s.load(i); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plain[s.off-i*sealChunk:])
+	s.off += int64(n)
+	return n, nil
+}
+
+// load decrypts chunk i.
+func (s *sealed) load(i int64) error {
+	full := int64(sealChunk + s.aead.Overhead())
+	if _, err := s.f.Seek(sealHeader+i*full, io.SeekStart); err != nil {
+		return err
+	}
+
+	n := full
+	if rest := s.f.size() - sealHeader - i*full; rest < n {
+		n = rest
+	}
+
+	if int64(cap(s.buf)) < n {
+		s.buf = make([]byte, full)
+	}
+	if _, err := io.ReadFull(s.f, s.buf[:n]); err != nil {
+		return err
+	}
+
+	plain, err := s.aead.Open(s.plain[:0], chunkNonce(s.aead, uint64(i), i == s.chunks-1), s.buf[:n], nil)
+	if err != nil {
+		s.i = -1
+		return fmt.Errorf("decrypt chunk %d: %v", i, err)
+	}
+
+	s.plain, s.i = plain, i
+	return nil
+}
+
+func (s *sealed) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.off
+	case io.SeekEnd:
+		offset += s.len
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+
+	s.off = offset
+	return offset, nil
+}
+
+func (s *sealed) Close() error {
+	return s.f.Close()
+}
+
+func (s *sealed) size() int64 {
+	return s.len
+}
+
+func (s *sealed) modTime() time.Time {
+	return s.f.modTime()
+}
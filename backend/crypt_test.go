@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+func testKeyring(t *testing.T, ids ...string) *keyring {
+	k := &keyring{keys: make(map[string]cipher.AEAD)}
+	for _, id := range ids {
+		if err := k.add(id, bytes.Repeat([]byte(id[:1]), 32)); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+	}
+
+	return k
+}
+
+func TestSeal(t *testing.T) {
+	d := newMemDriver()
+	s := &server{files: d}
+	dataKey := bytes.Repeat([]byte{7}, 32)
+
+	for _, size := range []int{0, 1, sealChunk - 1, sealChunk, sealChunk + 1, 3*sealChunk + 100} {
+		buf := make([]byte, size)
+		for i := range buf {
+			buf[i] = byte(i % 251)
+		}
+
+		w, err := s.createFile("f", dataKey)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+
+		// written in odd pieces
+		for rest := buf; len(rest) > 0; {
+			n := 1000
+			if n > len(rest) {
+				n = len(rest)
+			}
+			if _, err := w.Write(rest[:n]); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			rest = rest[n:]
+		}
+
+		if err := w.commit(); err != nil {
+			t.Fatalf("commit: %v", err)
+		}
+
+		raw := d.objects["f"].data
+		// short files turn up in random ciphertext by chance
+		if size > 16 && bytes.Contains(raw, buf) {
+			t.Errorf("%d: stored plainly", size)
+		}
+
+		f, err := s.openFile("f", dataKey)
+		if err != nil {
+			t.Fatalf("%d: open: %v", size, err)
+		}
+
+		if f.size() != int64(size) {
+			t.Errorf("%d: size %d", size, f.size())
+		}
+
+		res, err := ioutil.ReadAll(f)
+		if err != nil || !bytes.Equal(res, buf) {
+			t.Errorf("%d: read differs: %v", size, err)
+		}
+
+		// reads at any offset, across chunks
+		for _, off := range []int{size / 2, size - 1, sealChunk + 3} {
+			if off < 0 || off >= size {
+				continue
+			}
+
+			if _, err := f.Seek(int64(off), io.SeekStart); err != nil {
+				t.Fatalf("seek: %v", err)
+			}
+
+			res, err := ioutil.ReadAll(f)
+			if err != nil || !bytes.Equal(res, buf[off:]) {
+				t.Errorf("%d: read at %d differs: %v", size, off, err)
+			}
+		}
+		f.Close()
+
+		f, err = s.openFile("f", bytes.Repeat([]byte{8}, 32))
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		if _, err := ioutil.ReadAll(f); err == nil && size > 0 {
+			t.Errorf("%d: read with wrong key", size)
+		}
+		f.Close()
+	}
+}
+
+func TestSealTampered(t *testing.T) {
+	d := newMemDriver()
+	s := &server{files: d}
+	dataKey := bytes.Repeat([]byte{7}, 32)
+
+	w, err := s.createFile("f", dataKey)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := w.Write(make([]byte, 2*sealChunk)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := w.commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	raw := d.objects["f"].data
+
+	full := sealChunk + 16
+	for name, data := range map[string][]byte{
+		"flipped":   append(append([]byte{}, raw[:100]...), append([]byte{raw[100] ^ 1}, raw[101:]...)...),
+		"truncated": raw[:sealHeader+full],
+		"swapped":   append(append(append([]byte{}, raw[:sealHeader]...), raw[sealHeader+full:]...), raw[sealHeader:sealHeader+full]...),
+	} {
+		d.objects["f"] = memObject{data, time.Now()}
+
+		f, err := s.openFile("f", dataKey)
+		if err != nil {
+			continue
+		}
+
+		if _, err := ioutil.ReadAll(f); err == nil {
+			t.Errorf("%s: read succeeded", name)
+		}
+		f.Close()
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokenshare")
+	if err != nil {
+		t.Fatalf("tmpdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys")
+	lines := []string{
+		"# rotated 2024-03-01",
+		"new " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)),
+		"",
+		"old " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)),
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	k, err := loadKeyring(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	if k.current != "new" || len(k.keys) != 2 {
+		t.Errorf("current %s, %d keys", k.current, len(k.keys))
+	}
+
+	tok := tokenshare.Token{ID: []byte("token")}
+	dataKey := bytes.Repeat([]byte{3}, 32)
+	tok.DataKey, tok.KeyID, err = k.wrap(tok.ID, dataKey)
+	if err != nil {
+		t.Fatalf("wrap: %v", err)
+	}
+
+	res, err := k.unwrap(tok)
+	if err != nil || !bytes.Equal(res, dataKey) {
+		t.Errorf("unwrap: %x, %v", res, err)
+	}
+
+	// a wrapped key is bound to its token
+	tok.ID = []byte("other")
+	if _, err := k.unwrap(tok); err == nil {
+		t.Errorf("unwrapped key of another token")
+	}
+
+	for _, bad := range []string{"", "a", "a b", "a " + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if err := ioutil.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+
+		if _, err := loadKeyring(path); err == nil {
+			t.Errorf("loaded %q", bad)
+		}
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math/rand"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -11,35 +11,112 @@ import (
 )
 
 type database struct {
-	db      *bolt.DB
-	bucket  string
-	tokSize int
+	db     *bolt.DB
+	bucket string
+	ids    idScheme
 }
 
+// legacyToken is the part of a token record from before tokens held
+// several files, when the name of the single file was kept in the token.
+type legacyToken struct {
+	Name string `json:"name"`
+}
+
+// legacy returns the file names of the legacy tokens, by token ID.
+func (d *database) legacy() (map[string]string, error) {
+	names := make(map[string]string)
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(d.bucket))
+
+		return bucket.ForEach(func(k, v []byte) error {
+			var l legacyToken
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+
+			if l.Name != "" {
+				names[string(k)] = l.Name
+			}
+
+			return nil
+		})
+	})
+
+	return names, err
+}
+
+// blobBucket holds the records of the blobs, see blobs.go.
+const blobBucket = "blobs"
+
 func (d *database) init() error {
 	return d.db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(d.bucket))
+		if _, err := tx.CreateBucketIfNotExists([]byte(d.bucket)); err != nil {
+			return err
+		}
+
+		_, err := tx.CreateBucketIfNotExists([]byte(blobBucket))
 		return err
 	})
 }
 
 func (d *database) new() (tokenshare.Token, error) {
-	buf := make([]byte, d.tokSize)
-	if _, err := rand.Read(buf); err != nil {
+	buf, err := d.ids.new()
+	if err != nil {
 		return tokenshare.Token{}, err
 	}
 
-	return tokenshare.Token{ID: buf, T: time.Now()}, nil
+	return tokenshare.Token{ID: buf, Code: d.ids.encode(buf), T: time.Now()}, nil
 }
 
-func (d *database) insert(t tokenshare.Token) error {
-	buf, err := tokenshare.Marshal(t)
-	if err != nil {
-		return err
+// decode translates a code handed out in a link back to a token ID. Codes
+// that do not match the configured scheme are tried as hex, the scheme of
+// tokens created before IDs were configurable.
+func (d *database) decode(code string) ([]byte, error) {
+	id, err := d.ids.decode(code)
+	if err == nil {
+		return id, nil
+	}
+
+	if _, ok := d.ids.(hexIDs); ok {
+		return nil, err
 	}
 
+	if id, herr := hex.DecodeString(code); herr == nil {
+		return id, nil
+	}
+
+	return nil, err
+}
+
+// idAttempts is the number of IDs insert draws for a token before it gives
+// up. Short IDs collide now and then, more than a few collisions in a row
+// mean the ID space is used up.
+const idAttempts = 8
+
+// insert stores the new token t. A token that exists under the ID of t is
+// never replaced, t is given a new ID instead.
+func (d *database) insert(t *tokenshare.Token) error {
 	return d.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(d.bucket))
+
+		for i := 0; bucket.Get(t.ID) != nil; i++ {
+			if i == idAttempts {
+				return fmt.Errorf("no free token id after %d attempts", idAttempts)
+			}
+
+			id, err := d.ids.new()
+			if err != nil {
+				return err
+			}
+			t.ID, t.Code = id, d.ids.encode(id)
+		}
+
+		buf, err := tokenshare.Marshal(*t)
+		if err != nil {
+			return err
+		}
+
 		return bucket.Put(t.ID, buf)
 	})
 }
@@ -50,7 +127,7 @@ func (d *database) generate() (tokenshare.Token, error) {
 		return tokenshare.Token{}, err
 	}
 
-	if err := d.insert(t); err != nil {
+	if err := d.insert(&t); err != nil {
 		return tokenshare.Token{}, err
 	}
 
@@ -83,77 +160,129 @@ func (d *database) poke(id []byte) (tokenshare.Token, bool, error) {
 }
 
 func (d *database) update(id []byte, token tokenshare.Token) error {
-	return d.db.Update(func(tx *bolt.Tx) error {
+	_, err := d.modify(id, func(t *tokenshare.Token) error {
+		t.Files = token.Files
+		return nil
+	})
+
+	return err
+}
+
+// modify applies fn to the stored token within a single transaction and
+// returns the modified token. Nothing is written if fn fails.
+func (d *database) modify(id []byte, fn func(*tokenshare.Token) error) (tokenshare.Token, error) {
+	t, _, err := d.modifyRefs(id, func(t *tokenshare.Token, _ *blobRefs) error {
+		return fn(t)
+	})
+
+	return t, err
+}
+
+// modifyRefs is modify for changes that reference or release blobs, the
+// blob records are updated within the same transaction. It returns the
+// blobs that lost their last reference.
+func (d *database) modifyRefs(id []byte, fn func(*tokenshare.Token, *blobRefs) error) (tokenshare.Token, []string, error) {
+	var t tokenshare.Token
+	var refs *blobRefs
+
+	err := d.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(d.bucket))
 
-		d := bucket.Get(id)
-		if d == nil {
+		v := bucket.Get(id)
+		if v == nil {
 			return fmt.Errorf("no such token: %s", hex.EncodeToString(id))
 		}
-		t, err := tokenshare.Unmarshal(d)
+
+		var err error
+		t, err = tokenshare.Unmarshal(v)
 		if err != nil {
 			return err
 		}
 
-		t.Name = token.Name
+		refs = &blobRefs{bucket: tx.Bucket([]byte(blobBucket))}
+		if err := fn(&t, refs); err != nil {
+			return err
+		}
 
-		d, err = tokenshare.Marshal(t)
+		v, err = tokenshare.Marshal(t)
 		if err != nil {
 			return err
 		}
 
-		return bucket.Put(id, d)
+		return bucket.Put(id, v)
 	})
+	if err != nil {
+		return t, nil, err
+	}
+
+	return t, refs.released, nil
 }
 
-func (d *database) list() ([]byte, error) {
-	var res []byte
-	var marshalErr error
+// blob returns the record of blob sum.
+func (d *database) blob(sum string) (blob, bool, error) {
+	var b blob
+	var ok bool
 
-	if err := d.db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(d.bucket))
+	err := d.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b, ok, err = (&blobRefs{bucket: tx.Bucket([]byte(blobBucket))}).get(sum)
+		return err
+	})
 
-		n := bucket.Stats().KeyN
-		cursor := bucket.Cursor()
-		toks := make([]tokenshare.Token, n)
-		i := 0
+	return b, ok, err
+}
 
-		defer func() {
-			res, marshalErr = tokenshare.MarshalList(toks)
-		}()
+// modifyBlobs applies fn to all blob records within a single transaction,
+// the records fn reports changed are written.
+func (d *database) modifyBlobs(fn func(sum string, b *blob) (bool, error)) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		refs := &blobRefs{bucket: tx.Bucket([]byte(blobBucket))}
 
-		_, v := cursor.First()
-		if v == nil {
-			return nil
-		}
+		changed := make(map[string]blob)
+		if err := refs.bucket.ForEach(func(k, v []byte) error {
+			var b blob
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
 
-		tok, err := tokenshare.Unmarshal(v)
-		if err != nil {
+			ok, err := fn(string(k), &b)
+			if ok {
+				changed[string(k)] = b
+			}
+			return err
+		}); err != nil {
 			return err
 		}
-		toks[i] = tok
-		i++
 
-		for {
-			_, v := cursor.Next()
-			if v == nil {
-				return nil
+		// the bucket must not be changed while it is iterated
+		for sum, b := range changed {
+			if err := refs.put(sum, b); err != nil {
+				return err
 			}
+		}
+
+		return nil
+	})
+}
+
+func (d *database) list() ([]tokenshare.Token, error) {
+	toks := []tokenshare.Token{}
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(d.bucket))
 
+		return bucket.ForEach(func(_, v []byte) error {
 			tok, err := tokenshare.Unmarshal(v)
 			if err != nil {
 				return err
 			}
 
-			toks[i] = tok
-			i++
-
-		}
-	}); err != nil {
-		return nil, err
-	}
+			toks = append(toks, tok)
+			return nil
+		})
+	})
 
-	return res, marshalErr
+	return toks, err
 }
 
 func (d *database) single(id []byte) ([]byte, error) {
@@ -171,3 +300,34 @@ func (d *database) single(id []byte) ([]byte, error) {
 
 	return res, err
 }
+
+func (d *database) remove(id []byte) error {
+	return d.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(d.bucket))
+		return bucket.Delete(id)
+	})
+}
+
+// expired returns the IDs of all tokens that expired before now.
+func (d *database) expired(now time.Time) ([][]byte, error) {
+	var ids [][]byte
+
+	err := d.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(d.bucket))
+
+		return bucket.ForEach(func(k, v []byte) error {
+			tok, err := tokenshare.Unmarshal(v)
+			if err != nil {
+				return err
+			}
+
+			if tok.Expired(now) {
+				ids = append(ids, append([]byte(nil), k...))
+			}
+
+			return nil
+		})
+	})
+
+	return ids, err
+}
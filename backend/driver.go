@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// driver stores the files of tokens as objects under slash separated keys,
+// "<token>/<name>" for the files of a token. Drivers report missing objects
+// with errors matching fs.ErrNotExist.
+type driver interface {
+	// create starts writing the object key. It only becomes visible once
+	// the writer is committed.
+	create(key string) (writer, error)
+	// open returns the object key for reading.
+	open(key string) (object, error)
+	// rename moves the object from to the key to, replacing any object
+	// stored there. The move is atomic for readers of to.
+	rename(from, to string) error
+	// remove deletes the object key, removing a missing object is no error.
+	remove(key string) error
+	// removeAll deletes all objects below dir.
+	removeAll(dir string) error
+	// list returns the keys of all objects below dir, in lexical order.
+	list(dir string) ([]string, error)
+}
+
+// writer is an object being written by a driver.
+type writer interface {
+	io.Writer
+	// commit stores the object durably.
+	commit() error
+	// abort discards the object.
+	abort()
+}
+
+// object is a stored object being read.
+type object interface {
+	io.ReadSeeker
+	io.Closer
+	size() int64
+	modTime() time.Time
+}
+
+// localDriver keeps objects as files below root, keys are relative paths.
+type localDriver struct {
+	root string
+}
+
+func (d localDriver) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+type localWriter struct {
+	*os.File
+	path string
+}
+
+func (w localWriter) commit() error {
+	err := w.Sync()
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(w.Name(), w.path)
+	}
+	if err != nil {
+		_ = os.Remove(w.Name())
+		return err
+	}
+
+	return syncDir(filepath.Dir(w.path))
+}
+
+func (w localWriter) abort() {
+	w.Close()
+	_ = os.Remove(w.Name())
+}
+
+// create writes to a temporary file next to the object, which is renamed
+// to the key on commit.
+func (d localDriver) create(key string) (writer, error) {
+	p := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return nil, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), tempPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return localWriter{f, p}, nil
+}
+
+type localObject struct {
+	*os.File
+	stat os.FileInfo
+}
+
+func (o localObject) size() int64 {
+	return o.stat.Size()
+}
+
+func (o localObject) modTime() time.Time {
+	return o.stat.ModTime()
+}
+
+func (d localDriver) open(key string) (object, error) {
+	f, err := os.Open(d.path(key))
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return localObject{f, stat}, nil
+}
+
+// rename moves the file and syncs the directory, so the rename survives a
+// crash.
+func (d localDriver) rename(from, to string) error {
+	p := d.path(to)
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(d.path(from), p); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(p))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func (d localDriver) remove(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (d localDriver) free() (int64, error) {
+	return diskFree(d.root)
+}
+
+func (d localDriver) removeAll(dir string) error {
+	return os.RemoveAll(d.path(dir))
+}
+
+func (d localDriver) list(dir string) ([]string, error) {
+	var keys []string
+
+	err := filepath.WalkDir(d.path(dir), func(p string, e fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || e.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, filepath.ToSlash(rel))
+		return nil
+	})
+
+	return keys, err
+}
+
+// memDriver keeps objects in memory, for tests. The zero value is not
+// usable, see newMemDriver.
+type memDriver struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data []byte
+	t    time.Time
+}
+
+func newMemDriver() *memDriver {
+	return &memDriver{objects: make(map[string]memObject)}
+}
+
+type memWriter struct {
+	bytes.Buffer
+	key string
+	d   *memDriver
+}
+
+func (w *memWriter) commit() error {
+	w.d.mu.Lock()
+	defer w.d.mu.Unlock()
+
+	w.d.objects[w.key] = memObject{w.Bytes(), time.Now()}
+	return nil
+}
+
+func (w *memWriter) abort() {}
+
+func (d *memDriver) create(key string) (writer, error) {
+	return &memWriter{key: key, d: d}, nil
+}
+
+type memReader struct {
+	*bytes.Reader
+	t time.Time
+}
+
+func (r memReader) Close() error {
+	return nil
+}
+
+func (r memReader) modTime() time.Time {
+	return r.t
+}
+
+func (r memReader) size() int64 {
+	return r.Size()
+}
+
+func (d *memDriver) open(key string) (object, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	o, ok := d.objects[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrNotExist}
+	}
+
+	return memReader{bytes.NewReader(o.data), o.t}, nil
+}
+
+func (d *memDriver) rename(from, to string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	o, ok := d.objects[from]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: from, Err: fs.ErrNotExist}
+	}
+
+	delete(d.objects, from)
+	d.objects[to] = o
+	return nil
+}
+
+func (d *memDriver) remove(key string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.objects, key)
+	return nil
+}
+
+func (d *memDriver) removeAll(dir string) error {
+	keys, err := d.list(dir)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, key := range keys {
+		delete(d.objects, key)
+	}
+	return nil
+}
+
+func (d *memDriver) list(dir string) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
+	var keys []string
+	for key := range d.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// tempKey returns a new key for a temporary object in dir.
+func tempKey(dir string) (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return path.Join(dir, tempPrefix+hex.EncodeToString(buf)), nil
+}
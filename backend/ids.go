@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// idScheme generates token IDs and translates them from and to the form
+// that is handed out in links.
+type idScheme interface {
+	new() ([]byte, error)
+	encode(id []byte) string
+	decode(code string) ([]byte, error)
+}
+
+// idSizes holds the default size of each scheme.
+var idSizes = map[string]int{
+	"hex":    16,
+	"base32": 10,
+	"words":  5,
+}
+
+// newIDScheme returns the scheme called name. The size is the number of
+// random bytes for hex and base32 and the number of words for words, zero
+// selects the default of the scheme.
+func newIDScheme(name string, size int) (idScheme, error) {
+	if size == 0 {
+		size = idSizes[name]
+	}
+
+	if size < 0 {
+		return nil, fmt.Errorf("invalid id size: %d", size)
+	}
+
+	switch name {
+	case "hex":
+		return hexIDs{size}, nil
+	case "base32":
+		return base32IDs{size}, nil
+	case "words":
+		return wordIDs{size}, nil
+	}
+
+	return nil, fmt.Errorf("unknown id scheme: %s", name)
+}
+
+func random(size int) ([]byte, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+type hexIDs struct {
+	size int
+}
+
+func (h hexIDs) new() ([]byte, error) {
+	return random(h.size)
+}
+
+func (h hexIDs) encode(id []byte) string {
+	return hex.EncodeToString(id)
+}
+
+func (h hexIDs) decode(code string) ([]byte, error) {
+	return hex.DecodeString(strings.ToLower(code))
+}
+
+// crockford is the base32 alphabet by Douglas Crockford, it leaves out
+// letters that are easily confused.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// checksymbols extends the alphabet to the 37 check symbols.
+const checksymbols = crockford + "*~$=U"
+
+var crockfordEncoding = base32.NewEncoding(crockford).WithPadding(base32.NoPadding)
+
+// base32IDs encodes IDs in Crockford base32 followed by a check symbol,
+// which catches most typos when a code is read out or typed in.
+type base32IDs struct {
+	size int
+}
+
+func (b base32IDs) new() ([]byte, error) {
+	return random(b.size)
+}
+
+func (b base32IDs) encode(id []byte) string {
+	return crockfordEncoding.EncodeToString(id) + string(checksymbols[checksum(id)])
+}
+
+func (b base32IDs) decode(code string) ([]byte, error) {
+	code = strings.ToUpper(strings.Replace(code, "-", "", -1))
+	code = strings.NewReplacer("O", "0", "I", "1", "L", "1").Replace(code)
+	if len(code) < 2 {
+		return nil, fmt.Errorf("base32 id too short: %s", code)
+	}
+
+	id, err := crockfordEncoding.DecodeString(code[:len(code)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	if checksymbols[checksum(id)] != code[len(code)-1] {
+		return nil, fmt.Errorf("base32 id checksum mismatch: %s", code)
+	}
+
+	return id, nil
+}
+
+// checksum returns the value of id, read as big endian number, modulo 37.
+func checksum(id []byte) int {
+	sum := 0
+	for _, b := range id {
+		sum = (sum*256 + int(b)) % 37
+	}
+
+	return sum
+}
+
+// wordIDs encodes every byte of an ID as one word of the word list,
+// resulting in passphrases like "otter-maple-seven".
+type wordIDs struct {
+	words int
+}
+
+func (w wordIDs) new() ([]byte, error) {
+	return random(w.words)
+}
+
+func (w wordIDs) encode(id []byte) string {
+	words := make([]string, len(id))
+	for i, b := range id {
+		words[i] = wordlist[b]
+	}
+
+	return strings.Join(words, "-")
+}
+
+func (w wordIDs) decode(code string) ([]byte, error) {
+	words := strings.FieldsFunc(strings.ToLower(code), func(r rune) bool {
+		return r == '-' || r == ' ' || r == '.'
+	})
+
+	id := make([]byte, len(words))
+	for i, word := range words {
+		b, ok := wordindex[word]
+		if !ok {
+			return nil, fmt.Errorf("unknown word in id: %s", word)
+		}
+		id[i] = b
+	}
+
+	return id, nil
+}
+
+var wordindex = func() map[string]byte {
+	m := make(map[string]byte, len(wordlist))
+	for i, w := range wordlist {
+		m[w] = byte(i)
+	}
+
+	return m
+}()
+
+// wordlist holds 256 short, distinct words, one for each byte value.
+var wordlist = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alley",
+	"amber", "anchor", "angel", "ankle", "apple", "apron", "arena", "armor",
+	"arrow", "aspen", "atlas", "attic", "autumn", "badge", "bagel", "baker",
+	"bamboo", "banjo", "barley", "barn", "basil", "basket", "beach", "beacon",
+	"bean", "beard", "beaver", "bell", "berry", "bison", "blade", "boat",
+	"bonus", "book", "boot", "bottle", "bowl", "brick", "bridge", "broom",
+	"bubble", "bucket", "butter", "button", "cabin", "cactus", "camel",
+	"candle", "canoe", "canyon", "carbon", "carpet", "carrot", "castle",
+	"cedar", "cello", "chalk", "cherry", "chess", "chili", "circle", "citrus",
+	"clay", "cliff", "clock", "cloud", "clover", "coast", "cobra", "cocoa",
+	"comet", "copper", "coral", "cotton", "cougar", "crane", "crater",
+	"crayon", "cup", "daisy", "delta", "desert", "diamond", "dingo",
+	"dolphin", "donkey", "dragon", "drum", "eagle", "echo", "eight", "elbow",
+	"ember", "engine", "falcon", "feather", "fern", "ferry", "fiddle",
+	"field", "finch", "flame", "flint", "flute", "forest", "fossil", "fox",
+	"galaxy", "garden", "garlic", "gecko", "ginger", "globe", "goose",
+	"grape", "gravel", "guitar", "hammer", "harbor", "hazel", "hedge",
+	"helmet", "heron", "hill", "honey", "husky", "igloo", "indigo", "iris",
+	"island", "ivory", "jacket", "jaguar", "jelly", "jungle", "kayak",
+	"kettle", "kiwi", "koala", "ladder", "lagoon", "lantern", "lava", "lemon",
+	"lily", "linen", "lizard", "llama", "lotus", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "meteor", "mint", "mirror", "moose",
+	"mosaic", "moss", "nectar", "needle", "nickel", "nine", "noodle",
+	"nutmeg", "oasis", "ocean", "olive", "onion", "orbit", "orchid", "otter",
+	"owl", "oyster", "paddle", "palm", "panda", "paper", "parrot", "peach",
+	"pebble", "pepper", "piano", "pigeon", "pillow", "pine", "planet", "plum",
+	"pony", "poppy", "prism", "puffin", "pumpkin", "quartz", "quill",
+	"rabbit", "radish", "rain", "raven", "reef", "ribbon", "river", "robin",
+	"rocket", "rose", "ruby", "saddle", "salmon", "sand", "satin", "seven",
+	"shadow", "shell", "silver", "sparrow", "spider", "spruce", "squid",
+	"stone", "storm", "sugar", "summit", "sunset", "swan", "tango", "tiger",
+	"timber", "toast", "tomato", "topaz", "tulip", "tundra", "turtle",
+	"valley", "velvet", "violet", "violin", "walnut", "walrus", "willow",
+	"window", "winter", "wolf", "yogurt", "zebra", "zinc",
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestIDSchemes(t *testing.T) {
+	for _, name := range []string{"hex", "base32", "words"} {
+		ids, err := newIDScheme(name, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			id, err := ids.new()
+			if err != nil {
+				t.Fatalf("%s: new: %v", name, err)
+			}
+
+			code := ids.encode(id)
+			res, err := ids.decode(strings.ToUpper(code))
+			if err != nil {
+				t.Fatalf("%s: decode %s: %v", name, code, err)
+			}
+
+			if !bytes.Equal(res, id) {
+				t.Errorf("%s: %x != %x", name, res, id)
+			}
+		}
+	}
+}
+
+func TestBase32Checksum(t *testing.T) {
+	ids := base32IDs{10}
+	code := ids.encode([]byte("0123456789"))
+
+	// swap two adjacent symbols, a typical typo
+	typo := []byte(code)
+	typo[3], typo[4] = typo[4], typo[3]
+	if typo[3] == typo[4] {
+		t.Fatalf("test code has equal adjacent symbols: %s", code)
+	}
+
+	if _, err := ids.decode(string(typo)); err == nil {
+		t.Errorf("typo %s of %s not detected", typo, code)
+	}
+}
+
+func TestWordIDs(t *testing.T) {
+	ids := wordIDs{3}
+
+	id, err := ids.decode("Otter maple-seven")
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	if code := ids.encode(id); code != "otter-maple-seven" {
+		t.Errorf("%s != otter-maple-seven", code)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+// locks serializes the uploads to a token. A token is locked while a file
+// is written to it, so that concurrent uploads cannot interleave their
+// writes and limit checks. The zero value is ready to use.
+type locks struct {
+	mu   sync.Mutex
+	held map[string]chan struct{}
+}
+
+// acquire locks key. If it is held already, acquire waits for up to wait
+// for its release and gives up earlier if ctx is done. It reports whether
+// the lock was acquired.
+func (l *locks) acquire(ctx context.Context, key string, wait time.Duration) bool {
+	var deadline <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		l.mu.Lock()
+		if l.held == nil {
+			l.held = make(map[string]chan struct{})
+		}
+
+		released, busy := l.held[key]
+		if !busy {
+			l.held[key] = make(chan struct{})
+			l.mu.Unlock()
+			return true
+		}
+		l.mu.Unlock()
+
+		if wait <= 0 {
+			return false
+		}
+
+		select {
+		case <-released:
+		case <-deadline:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// release unlocks key and wakes up all waiting uploads.
+func (l *locks) release(key string) {
+	l.mu.Lock()
+	released := l.held[key]
+	delete(l.held, key)
+	l.mu.Unlock()
+
+	if released != nil {
+		close(released)
+	}
+}
+
+// exclusive acquires the upload lock of the token. It returns the token as
+// stored once the lock is held, since a queued upload may have changed it,
+// and a function that releases the lock. It reports false after writing an
+// error response, 409 if another upload holds the lock.
+func (s *server) exclusive(w http.ResponseWriter, req *http.Request, bid []byte) (tokenshare.Token, func(), bool) {
+	key := hex.EncodeToString(bid)
+	if !s.uploads.acquire(req.Context(), key, s.queue) {
+		http.Error(w, "another upload to this token is in progress", http.StatusConflict)
+		return tokenshare.Token{}, nil, false
+	}
+	release := func() { s.uploads.release(key) }
+
+	token, ok, err := s.poke(bid)
+	if err != nil {
+		release()
+		http.Error(w, fmt.Sprintf("unable to get token: %v", err), http.StatusInternalServerError)
+		return tokenshare.Token{}, nil, false
+	}
+
+	if !ok {
+		release()
+		http.Error(w, tokenshare.NoSuchToken{}.Error(), http.StatusBadRequest)
+		return tokenshare.Token{}, nil, false
+	}
+
+	return token, release, true
+}
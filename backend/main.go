@@ -1,15 +1,92 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 func main() {
-	server, err := newSrv("bolt.db", "token", "storage", "www", "user", "pass", 16, int64(1024*1024*1024))
+	reap := flag.Duration("reap", time.Hour, "interval between sweeps for expired tokens, 0 disables the reaper")
+	scheme := flag.String("ids", "hex", "token id scheme: hex, base32 or words")
+	size := flag.Int("id-size", 0, "random bytes of hex and base32 ids or number of words, 0 selects the scheme default")
+	compress := flag.String("compress", "", "compression of stored files: gzip, zstd or empty for none")
+	queue := flag.Duration("upload-queue", 0, "time a concurrent upload to the same token waits for the running one, 0 rejects it right away")
+	uploadTTL := flag.Duration("upload-ttl", 24*time.Hour, "time an interrupted resumable upload is kept for its sender to resume it, 0 keeps it until the token is gone")
+	storage := flag.String("storage", "local", "storage of files: local or s3")
+	endpoint := flag.String("s3-endpoint", "", "URL of the S3 compatible object store, credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	bucket := flag.String("s3-bucket", "", "bucket of the object store files are kept in")
+	region := flag.String("s3-region", "us-east-1", "region of the object store")
+	masterKeys := flag.String("master-keys", "", "file of master keys stored files are encrypted with, one id and base64 key per line, the first is current; empty disables encryption")
+	dedup := flag.Bool("dedup", false, "store files with the same content only once, files stored before are kept as they are")
+	quota := flag.Int64("quota", 0, "bytes all tokens may hold together, counted as uploaded before compression and deduplication, 0 is unlimited")
+	adminQuota := flag.Int64("admin-quota", 0, "bytes the tokens of an admin may hold, counted as uploaded before compression and deduplication, 0 is unlimited; the single admin owns all tokens, so this limits them like -quota")
+	flag.Parse()
+
+	ids, err := newIDScheme(*scheme, *size)
+	if err != nil {
+		log.Fatalf("ids: %v", err)
+	}
+
+	if err := checkEncoding(*compress); err != nil {
+		log.Fatalf("compress: %v", err)
+	}
+
+	server, err := newSrv("bolt.db", "token", "storage", "www", "user", "pass", int64(1024*1024*1024))
 	if err != nil {
 		log.Fatalf("server: %v", err)
 	}
+	server.ids = ids
+	server.queue = *queue
+	server.uploadTTL = *uploadTTL
+	server.compress = *compress
+	server.dedup = *dedup
+	server.quota = *quota
+	server.adminQuota = *adminQuota
+
+	switch *storage {
+	case "local":
+	case "s3":
+		files, err := newS3Driver(*endpoint, *bucket, *region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		if err != nil {
+			log.Fatalf("storage: %v", err)
+		}
+		server.files = files
+	default:
+		log.Fatalf("storage: unknown driver %q", *storage)
+	}
+
+	if *masterKeys != "" {
+		if server.keys, err = loadKeyring(*masterKeys); err != nil {
+			log.Fatalf("master keys: %v", err)
+		}
+
+		// data keys wrapped with an older master key are rewrapped, so
+		// that the older key can be dropped afterwards
+		n, err := server.rewrap()
+		if err != nil {
+			log.Fatalf("rewrap: %v", err)
+		}
+		log.Printf("rewrapped %d data keys with master key %s", n, server.keys.current)
+	}
+
+	n, err := server.migrate()
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	if n > 0 {
+		log.Printf("migrated %d tokens from before multi-file support", n)
+	}
+
+	if err := server.scrub(); err != nil {
+		log.Fatalf("scrub: %v", err)
+	}
+
+	if *reap > 0 {
+		go server.reap(*reap)
+	}
 
 	if err := http.ListenAndServe(":8080", server.mux); err != nil {
 		log.Fatalf("server: %v", err)
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+// maxName is the longest file name accepted, in bytes. It is the limit of
+// most file systems.
+const maxName = 255
+
+// reserved are the device names Windows refuses to create files for, with
+// any extension.
+var reserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitize returns the name a file sent by a client is stored under. Path
+// components of either separator are stripped, as are leading and trailing
+// spaces and trailing dots. Names with control characters or invalid UTF-8,
+// reserved names and names of the server's own files are rejected.
+func sanitize(name string) (string, error) {
+	name = tokenshare.StoredName(name)
+
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("invalid file name: %q is not UTF-8", name)
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("invalid file name: %q contains control characters", name)
+		}
+	}
+
+	base := strings.TrimSpace(strings.SplitN(name, ".", 2)[0])
+	switch {
+	case name == "":
+		return "", fmt.Errorf("invalid file name: empty")
+	case len(name) > maxName:
+		return "", fmt.Errorf("invalid file name: longer than %d bytes", maxName)
+	case reserved[strings.ToUpper(base)], strings.HasPrefix(name, tempPrefix), name == tokenshare.ManifestName:
+		return "", fmt.Errorf("invalid file name: %q is reserved", name)
+	}
+
+	return name, nil
+}
+
+// unique resolves collisions of name with the files of tok. A file of the
+// same name is replaced, but a name that differs only in case from a stored
+// one would overwrite it on case-insensitive file systems and in extracted
+// archives, it gets a numbered suffix instead: "Report (1).pdf".
+func unique(tok tokenshare.Token, name string) string {
+	taken := func(n string) bool {
+		for _, f := range tok.Files {
+			if f.Name != name && strings.EqualFold(f.Name, n) {
+				return true
+			}
+		}
+		for _, p := range tok.Uploads {
+			if p.Name != name && strings.EqualFold(p.Name, n) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	next := name
+	for i := 1; taken(next); i++ {
+		next = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+	}
+
+	return next
+}
+
+// disposition returns the Content-Disposition header of a download of
+// name. The filename parameter holds an ASCII fallback for old clients,
+// filename* the name itself encoded as of RFC 5987.
+func disposition(name string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+
+	var enc strings.Builder
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			enc.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&enc, "%%%02X", b)
+	}
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback, enc.String())
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+func TestSanitize(t *testing.T) {
+	valid := map[string]string{
+		"report.pdf":           "report.pdf",
+		"../../etc/passwd":     "passwd",
+		`C:\Users\me\foo.txt`:  "foo.txt",
+		"  spaced.txt . ":      "spaced.txt",
+		"Überweisung 2024.pdf": "Überweisung 2024.pdf",
+		"console.log":          "console.log",
+	}
+
+	for in, want := range valid {
+		got, err := sanitize(in)
+		if err != nil || got != want {
+			t.Errorf("sanitize(%q) = %q, %v, want %q", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "..", "dir/", "foo\x00bar", "tab\there", "NUL", "com1.txt", "Lpt9 .log", "\xff.txt", ".upload-123", tokenshare.ManifestName, strings.Repeat("a", maxName+1)} {
+		if got, err := sanitize(in); err == nil {
+			t.Errorf("sanitize(%q) = %q, want error", in, got)
+		}
+	}
+}
+
+func TestUnique(t *testing.T) {
+	tok := tokenshare.Token{Files: []tokenshare.FileInfo{{Name: "Report.pdf"}, {Name: "report (1).pdf"}}}
+
+	for in, want := range map[string]string{
+		"Report.pdf": "Report.pdf",
+		"REPORT.PDF": "REPORT (2).PDF",
+		"other.pdf":  "other.pdf",
+		"README":     "README",
+	} {
+		if got := unique(tok, in); got != want {
+			t.Errorf("unique(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDisposition(t *testing.T) {
+	_, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	name := `../Grüße "2024".txt`
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, name, id, "", []byte("FOO"), nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	toks, err := tokenshare.List(testSrv.URL+tokenshare.ReqList, cookie)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	stored := `Grüße "2024".txt`
+	if len(toks) != 1 || len(toks[0].Files) != 1 || toks[0].Files[0].Name != stored {
+		t.Fatalf("unexpected list: %v", toks)
+	}
+
+	resp, err := http.Get(testSrv.URL + tokenshare.ReqDownload + "?" + tokenshare.ID + "=" + id)
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	header := resp.Header.Get("Content-Disposition")
+	if !strings.Contains(header, `filename="Gr__e _2024_.txt"`) {
+		t.Errorf("unexpected fallback: %s", header)
+	}
+
+	// mime decodes the RFC 5987 parameter in favour of the fallback
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil || params["filename"] != stored {
+		t.Errorf("unexpected filename: %v, %v", params, err)
+	}
+}
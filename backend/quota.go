@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+// Quotas count the bytes of files as they were uploaded. A file counts with
+// its full size for every token it belongs to, even if it is stored
+// compressed or deduplicated, so the usage of an admin does not depend on
+// what others uploaded.
+//
+// The server has a single admin for now, which owns all tokens. Its quota
+// limits the same tokens as the global one, it only matters once tokens
+// have different owners.
+
+// spacer is implemented by drivers that know the free space of their
+// storage.
+type spacer interface {
+	free() (int64, error)
+}
+
+// held returns the bytes held by tok. A pending resumable upload counts
+// with its declared size, the files of revoked and downloaded out tokens
+// are gone.
+func held(tok tokenshare.Token) int64 {
+	if tok.State() == tokenshare.StatusRevoked || tok.Exhausted() {
+		return 0
+	}
+
+	n := tok.Size()
+	for _, p := range tok.Uploads {
+		n += p.Size
+	}
+
+	return n
+}
+
+// owner returns the admin tok belongs to. Tokens created before owners
+// were recorded belong to the admin of the server.
+func (s *server) owner(tok tokenshare.Token) string {
+	if tok.Owner == "" {
+		return s.user
+	}
+
+	return tok.Owner
+}
+
+// usage returns the bytes held by all tokens and by the tokens of admin.
+func (s *server) usage(admin string) (int64, int64, error) {
+	return s.usageWithout(nil, admin)
+}
+
+// usageWithout is usage for all tokens but bid.
+func (s *server) usageWithout(bid []byte, admin string) (int64, int64, error) {
+	toks, err := s.database.list()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var all, owned int64
+	for _, tok := range toks {
+		if bytes.Equal(tok.ID, bid) {
+			continue
+		}
+
+		n := held(tok)
+		all += n
+		if s.owner(tok) == admin {
+			owned += n
+		}
+	}
+
+	return all, owned, nil
+}
+
+// free returns the free space of the storage, -1 if the driver does not
+// know it.
+func (s *server) free() (int64, error) {
+	sp, ok := s.files.(spacer)
+	if !ok {
+		return -1, nil
+	}
+
+	return sp.free()
+}
+
+// room returns how many more bytes tok may hold under the quotas and the
+// free space of the storage, -1 if there is no limit.
+func (s *server) room(tok tokenshare.Token) (int64, error) {
+	all, owned, err := s.usage(s.owner(tok))
+	if err != nil {
+		return 0, err
+	}
+
+	free, err := s.free()
+	if err != nil {
+		return 0, err
+	}
+
+	room := int64(-1)
+	limit := func(n int64) {
+		if n < 0 {
+			n = 0
+		}
+		if room < 0 || n < room {
+			room = n
+		}
+	}
+
+	if s.quota > 0 {
+		limit(s.quota - all)
+	}
+	if s.adminQuota > 0 {
+		limit(s.adminQuota - owned)
+	}
+	if free >= 0 {
+		limit(free)
+	}
+
+	return room, nil
+}
+
+// admit checks up front whether size more bytes for tok fit into the
+// quotas and the free space of the storage. A negative size is unknown,
+// the upload is only refused if a quota is used up already, the rest is
+// checked while it streams, see room. It reports false after writing an error response.
+func (s *server) admit(w http.ResponseWriter, tok tokenshare.Token, size int64) bool {
+	if size < 0 {
+		size = 0
+	}
+
+	all, owned, err := s.usage(s.owner(tok))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("usage: %v", err), http.StatusInternalServerError)
+		return false
+	}
+
+	free, err := s.free()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("free space: %v", err), http.StatusInternalServerError)
+		return false
+	}
+
+	switch {
+	case s.quota > 0 && all+size > s.quota:
+		http.Error(w, fmt.Sprintf("%v: %d of %d bytes used", tokenshare.QuotaExceeded{}, all, s.quota), code(tokenshare.QuotaExceeded{}))
+	case s.adminQuota > 0 && owned+size > s.adminQuota:
+		http.Error(w, fmt.Sprintf("%v: %d of %d bytes used by %s", tokenshare.QuotaExceeded{}, owned, s.adminQuota, s.owner(tok)), code(tokenshare.QuotaExceeded{}))
+	case free >= 0 && size > free:
+		http.Error(w, fmt.Sprintf("%v: %d bytes free", tokenshare.QuotaExceeded{}, free), code(tokenshare.QuotaExceeded{}))
+	default:
+		return true
+	}
+
+	return false
+}
+
+// fits checks whether the bytes held by t fit into the quotas, with all
+// and owned the bytes held by the other tokens, and those of its owner,
+// see usageWithout.
+func (s *server) fits(t tokenshare.Token, all, owned int64) error {
+	n := held(t)
+	if (s.quota > 0 && all+n > s.quota) || (s.adminQuota > 0 && owned+n > s.adminQuota) {
+		return tokenshare.QuotaExceeded{}
+	}
+
+	return nil
+}
+
+// usageReport reports the storage usage to the admin.
+func (s *server) usageReport(w http.ResponseWriter, req *http.Request) {
+	if !s.checkCookie(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	all, owned, err := s.usage(s.user)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	free, err := s.free()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("free space: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	buf, err := json.Marshal(tokenshare.Usage{
+		Used:       all,
+		Quota:      s.quota,
+		Admin:      s.user,
+		AdminUsed:  owned,
+		AdminQuota: s.adminQuota,
+		Free:       free,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("marshal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write(buf)
+}
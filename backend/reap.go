@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// reap deletes expired tokens every interval. It never returns.
+func (s *server) reap(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := s.sweep(now); err != nil {
+			log.Printf("reap: %v", err)
+		}
+	}
+}
+
+// sweep deletes all tokens that expired before now, together with their
+// stored files. A token that cannot be purged is logged and tried again
+// with the next sweep, it does not hold up the others. Resumable uploads
+// that received nothing for the upload TTL are dropped.
+func (s *server) sweep(now time.Time) error {
+	ids, err := s.database.expired(now)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := s.purge(id); err != nil {
+			log.Printf("purge %s: %v", hex.EncodeToString(id), err)
+		}
+	}
+
+	if s.uploadTTL <= 0 {
+		return nil
+	}
+
+	toks, err := s.database.list()
+	if err != nil {
+		return err
+	}
+
+	// uploads recorded before their activity was tracked count as stale
+	for _, tok := range toks {
+		for _, p := range tok.Uploads {
+			if now.Sub(p.T) > s.uploadTTL {
+				s.dropUpload(tok.ID, p.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// purge removes the stored files of a token and its database record.
+func (s *server) purge(id []byte) error {
+	if err := s.clear(id); err != nil {
+		return err
+	}
+
+	return s.database.remove(id)
+}
+
+// clear removes the stored files and partial uploads of a token.
+func (s *server) clear(id []byte) error {
+	if err := s.release(id); err != nil {
+		return err
+	}
+
+	return s.files.removeAll(path.Join(partial, hex.EncodeToString(id)))
+}
+
+// scrub removes the temporary files of uploads that were interrupted by a
+// crash, and blobs that lost their record in one. It must run before the
+// server accepts uploads.
+func (s *server) scrub() error {
+	keys, err := s.files.list("")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if dir, sum := path.Split(key); dir == blobDir+"/" {
+			_, ok, err := s.database.blob(sum)
+			if err != nil {
+				return err
+			}
+			if ok {
+				continue
+			}
+		} else if !strings.HasPrefix(path.Base(key), tempPrefix) {
+			continue
+		}
+
+		if err := s.files.remove(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
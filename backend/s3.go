@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3PartSize is the size of the parts of multipart uploads, the minimum S3
+// accepts for all but the last part.
+const s3PartSize = 5 * 1024 * 1024
+
+// s3CopySize is the largest object copied with a single request, larger
+// ones are copied in parts of this size. S3 copies at most 5 GiB at once,
+// and a part of a multipart copy has to complete within s3Timeout.
+const s3CopySize = 512 * 1024 * 1024
+
+// s3Timeout bounds every request to the object store, but the reading of
+// objects, which are streamed for as long as a download takes. There only
+// the response headers have to arrive within the timeout.
+const s3Timeout = 5 * time.Minute
+
+// s3Driver stores objects in a bucket of an S3 compatible object store.
+// Requests use path style addressing and are signed with AWS signature
+// version 4, so the driver works with AWS as well as with MinIO and
+// similar servers.
+type s3Driver struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+
+	access, secret string
+
+	partSize int
+	copySize int64
+	client   *http.Client
+	reader   *http.Client
+}
+
+func newS3Driver(endpoint, bucket, region, access, secret string) (*s3Driver, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme == "" || u.Host == "" || bucket == "" {
+		return nil, fmt.Errorf("s3: endpoint and bucket required")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = s3Timeout
+
+	return &s3Driver{
+		endpoint: u,
+		bucket:   bucket,
+		region:   region,
+		access:   access,
+		secret:   secret,
+		partSize: s3PartSize,
+		copySize: s3CopySize,
+		client:   &http.Client{Transport: transport, Timeout: s3Timeout},
+		reader:   &http.Client{Transport: transport},
+	}, nil
+}
+
+// s3Error is an error response of the object store.
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Is makes missing objects match fs.ErrNotExist.
+func (e s3Error) Is(target error) bool {
+	return target == fs.ErrNotExist && e.Status == http.StatusNotFound
+}
+
+// request builds the signed request for key, with body as payload.
+func (d *s3Driver) request(method, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	u := *d.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + d.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	sign(req, hex.EncodeToString(sum[:]), d.access, d.secret, d.region, time.Now())
+	return req, nil
+}
+
+// do sends the request and returns the response if its status is one of
+// ok, or the error of the object store otherwise.
+func (d *s3Driver) do(req *http.Request, ok ...int) (*http.Response, error) {
+	return d.send(d.client, req, ok...)
+}
+
+// send is do with the client the request is sent with.
+func (d *s3Driver) send(client *http.Client, req *http.Request, ok ...int) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	e := s3Error{Status: resp.StatusCode}
+	buf, _ := ioutil.ReadAll(resp.Body)
+	_ = xml.Unmarshal(buf, &e)
+	return nil, e
+}
+
+// call is do for requests whose response body is not needed.
+func (d *s3Driver) call(method, key string, query url.Values, header http.Header, body []byte, ok ...int) (http.Header, error) {
+	req, err := d.request(method, key, query, header, body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.do(req, ok...)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return resp.Header, nil
+}
+
+// s3Writer buffers a part of the object. Objects of up to a single part
+// are stored with one PUT, larger ones with a multipart upload.
+type s3Writer struct {
+	d   *s3Driver
+	key string
+	buf []byte
+
+	upload string
+	etags  []string
+}
+
+func (d *s3Driver) create(key string) (writer, error) {
+	return &s3Writer{d: d, key: key}, nil
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := w.d.partSize - len(w.buf)
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf = append(w.buf, p[:room]...)
+		p = p[room:]
+
+		if len(w.buf) == w.d.partSize {
+			if err := w.flush(); err != nil {
+				return n - len(p), err
+			}
+		}
+	}
+
+	return n, nil
+}
+
+// start starts the multipart upload, unless it is already running.
+func (w *s3Writer) start() error {
+	if w.upload != "" {
+		return nil
+	}
+
+	req, err := w.d.request(http.MethodPost, w.key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.d.do(req, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return err
+	}
+
+	w.upload = res.UploadID
+	return nil
+}
+
+// flush uploads the buffer as the next part, starting the multipart
+// upload with the first one.
+func (w *s3Writer) flush() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	query := url.Values{"partNumber": {strconv.Itoa(len(w.etags) + 1)}, "uploadId": {w.upload}}
+	header, err := w.d.call(http.MethodPut, w.key, query, nil, w.buf, http.StatusOK)
+	if err != nil {
+		return err
+	}
+
+	w.etags = append(w.etags, header.Get("ETag"))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (w *s3Writer) commit() error {
+	if w.upload == "" {
+		_, err := w.d.call(http.MethodPut, w.key, nil, nil, w.buf, http.StatusOK)
+		return err
+	}
+
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			w.abort()
+			return err
+		}
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, s3Part{i + 1, etag})
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	// errors of a completion may be reported with status 200
+	req, err := w.d.request(http.MethodPost, w.key, url.Values{"uploadId": {w.upload}}, nil, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.d.do(req, http.StatusOK)
+	if err != nil {
+		w.abort()
+		return err
+	}
+	defer resp.Body.Close()
+
+	return s3Check(resp)
+}
+
+func (w *s3Writer) abort() {
+	if w.upload == "" {
+		return
+	}
+
+	_, _ = w.d.call(http.MethodDelete, w.key, url.Values{"uploadId": {w.upload}}, nil, nil, http.StatusNoContent, http.StatusNotFound)
+	w.upload = ""
+}
+
+// s3Check reads a response that may carry an error despite its status.
+func s3Check(resp *http.Response) error {
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Contains(buf, []byte("<Error>")) {
+		return nil
+	}
+
+	e := s3Error{Status: resp.StatusCode}
+	_ = xml.Unmarshal(buf, &e)
+	return e
+}
+
+// s3Object reads an object with range requests, starting a new one after
+// every seek.
+type s3Object struct {
+	d    *s3Driver
+	key  string
+	len  int64
+	t    time.Time
+	off  int64
+	body io.ReadCloser
+}
+
+func (d *s3Driver) open(key string) (object, error) {
+	header, err := d.call(http.MethodHead, key, nil, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %s: invalid Content-Length", key)
+	}
+
+	t, _ := http.ParseTime(header.Get("Last-Modified"))
+	return &s3Object{d: d, key: key, len: size, t: t}, nil
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.len {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", o.off)}}
+		req, err := o.d.request(http.MethodGet, o.key, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		resp, err := o.d.send(o.d.reader, req, http.StatusPartialContent, http.StatusOK)
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode == http.StatusOK && o.off > 0 {
+			resp.Body.Close()
+			return 0, fmt.Errorf("s3: %s: range not supported", o.key)
+		}
+		o.body = resp.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.len
+	}
+
+	if offset < 0 {
+		return 0, errors.New("seek before start of object")
+	}
+
+	if offset != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+
+	o.off = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	return o.body.Close()
+}
+
+func (o *s3Object) size() int64 {
+	return o.len
+}
+
+func (o *s3Object) modTime() time.Time {
+	return o.t
+}
+
+// rename copies the object and deletes the original, S3 has no move.
+// Objects larger than copySize are copied in parts.
+func (d *s3Driver) rename(from, to string) error {
+	src, err := d.open(from)
+	if err != nil {
+		return err
+	}
+	size := src.size()
+	src.Close()
+
+	header := http.Header{"X-Amz-Copy-Source": {s3Escape("/"+d.bucket+"/"+from, true)}}
+	if size > d.copySize {
+		err = d.copyParts(to, header, size)
+	} else {
+		_, err = d.copy(to, nil, header)
+	}
+	if err != nil {
+		return err
+	}
+
+	return d.remove(from)
+}
+
+// copy sends a copy request for the key to and returns the ETag of the
+// copy. Errors of a copy may be reported with status 200.
+func (d *s3Driver) copy(to string, query url.Values, header http.Header) (string, error) {
+	req, err := d.request(http.MethodPut, to, query, header, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := d.do(req, http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var res struct {
+		XMLName xml.Name
+		ETag    string `xml:"ETag"`
+		s3Error
+	}
+	if err := xml.Unmarshal(buf, &res); err != nil {
+		return "", err
+	}
+
+	if res.XMLName.Local == "Error" {
+		res.s3Error.Status = resp.StatusCode
+		return "", res.s3Error
+	}
+
+	return res.ETag, nil
+}
+
+// copyParts copies the source of header to the key to with a multipart
+// upload, in parts of copySize.
+func (d *s3Driver) copyParts(to string, header http.Header, size int64) error {
+	w := &s3Writer{d: d, key: to}
+	if err := w.start(); err != nil {
+		return err
+	}
+
+	for off := int64(0); off < size; off += d.copySize {
+		end := off + d.copySize
+		if end > size {
+			end = size
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(len(w.etags) + 1)}, "uploadId": {w.upload}}
+		part := http.Header{
+			"X-Amz-Copy-Source":       header["X-Amz-Copy-Source"],
+			"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)},
+		}
+
+		etag, err := d.copy(to, query, part)
+		if err != nil {
+			w.abort()
+			return err
+		}
+		w.etags = append(w.etags, etag)
+	}
+
+	return w.commit()
+}
+
+func (d *s3Driver) remove(key string) error {
+	_, err := d.call(http.MethodDelete, key, nil, nil, nil, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	return err
+}
+
+func (d *s3Driver) removeAll(dir string) error {
+	keys, err := d.list(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := d.remove(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *s3Driver) list(dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		req, err := d.request(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := d.do(req, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+
+		var res struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range res.Contents {
+			keys = append(keys, c.Key)
+		}
+
+		if !res.IsTruncated {
+			break
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// sign adds the AWS signature version 4 to req. The host, the range and
+// all x-amz headers are signed, payload is the hex encoded SHA-256 of the
+// body.
+func sign(req *http.Request, payload, access, secret, region string, t time.Time) {
+	t = t.UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+
+	canonical, signed := canonicalRequest(req, payload)
+	scope := date + "/" + region + "/s3/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		access, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// canonicalRequest returns the canonical form of req signed by sign and
+// the list of signed headers.
+func canonicalRequest(req *http.Request, payload string) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") || k == "range" {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	return strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		s3Query(req.URL.Query()),
+		canonical.String(),
+		signed,
+		payload,
+	}, "\n"), signed
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Query encodes a query string in the canonical form of signature
+// version 4, sorted and with values that are percent encoded by s3Escape.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent encodes all but the unreserved characters of s, and the
+// slash if path is set.
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -1,26 +1,44 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/jostillmanns/tokenshare"
+	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	index  = "index.html"
-	upload = "upload.html"
-	js     = "app.js"
+	index   = "index.html"
+	upload  = "upload.html"
+	receive = "receive.html"
+	js      = "app.js"
+
+	// multipartOverhead is the allowance for multipart headers, boundaries
+	// and form fields on top of the per-token upload size.
+	multipartOverhead = 64 * 1024
 )
 
-func newSrv(db, bucket, storage, static, user, pass string, tokenSize int, maxMemory int64) (*server, error) {
+func newSrv(db, bucket, storage, static, user, pass string, maxMemory int64) (*server, error) {
 	bolt, err := bolt.Open(db, 0600, nil)
 	if err != nil {
 		return nil, err
@@ -35,12 +53,13 @@ func newSrv(db, bucket, storage, static, user, pass string, tokenSize int, maxMe
 		maxMemory: maxMemory,
 
 		storage: storage,
+		files:   localDriver{storage},
 		static:  static,
 
 		database: database{
-			db:      bolt,
-			bucket:  bucket,
-			tokSize: tokenSize,
+			db:     bolt,
+			bucket: bucket,
+			ids:    hexIDs{idSizes["hex"]},
 		},
 	}
 
@@ -54,12 +73,21 @@ func newSrv(db, bucket, storage, static, user, pass string, tokenSize int, maxMe
 	mux.HandleFunc("/app.js.map", s.client)
 	mux.HandleFunc("/upload.js", s.client)
 	mux.HandleFunc("/upload.js.map", s.client)
+	mux.HandleFunc("/receive.js", s.client)
+	mux.HandleFunc("/receive.js.map", s.client)
 	mux.HandleFunc(tokenshare.ReqList, s.list)
 	mux.HandleFunc(tokenshare.ReqDownload, s.download)
 	mux.HandleFunc(tokenshare.ReqCreate, s.create)
+	mux.HandleFunc(tokenshare.ReqDelete, s.delete)
+	mux.HandleFunc(tokenshare.ReqRevoke, s.revoke)
 	mux.HandleFunc(tokenshare.ReqUpload, s.upload)
+	mux.HandleFunc(tokenshare.ReqShare, s.share)
+	mux.HandleFunc(tokenshare.ReqReceive, s.receive)
 	mux.HandleFunc(tokenshare.ReqTransfer, s.transfer)
+	mux.HandleFunc(tokenshare.ReqResumable, s.resumable)
+	mux.HandleFunc(tokenshare.ReqPut, s.put)
 	mux.HandleFunc(tokenshare.ReqSingle, s.single)
+	mux.HandleFunc(tokenshare.ReqUsage, s.usageReport)
 
 	return s, nil
 }
@@ -70,26 +98,150 @@ type server struct {
 
 	maxMemory int64
 
+	// storage is the directory of the local driver, files the driver
+	// all files are stored with.
 	storage string
-	static  string
+	files   driver
+
+	static string
+
+	// keys are the master keys files are encrypted with, they are stored
+	// plainly if it is nil.
+	keys *keyring
+
+	// quota limits the bytes held by all tokens, adminQuota those held by
+	// the tokens of an admin, all of them with the single admin of the
+	// server. Zero is unlimited.
+	quota, adminQuota int64
+
+	// compress is the encoding files are stored with, none if empty.
+	compress string
+
+	// dedup stores new files once per content, see blobs.go. blobLock
+	// orders the changes to the blob references.
+	dedup    bool
+	blobLock sync.Mutex
+
+	// uploads locks tokens during an upload, a concurrent upload waits
+	// for up to queue before it is rejected.
+	uploads locks
+	queue   time.Duration
+
+	// uploadTTL is the time a resumable upload is kept without receiving
+	// bytes. Zero keeps it until its token is gone.
+	uploadTTL time.Duration
 
 	database
 }
 
-func (s *server) write(name, id string, rdr io.Reader) error {
-	dir := filepath.Join(s.storage, id)
-	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
-		return err
+// errLimit is returned by write once the reader yields more than the
+// allowed number of bytes.
+var errLimit = errors.New("size limit exceeded")
+
+// tempPrefix starts the names of files that are still being written.
+const tempPrefix = ".upload-"
+
+// write copies rdr to a new temporary object of token id and returns its
+// key and the number of bytes read. The object is stored durably, but only
+// moved to its name by place, so a failed upload never replaces a stored
+// file. At most limit bytes are accepted, a negative limit disables the
+// check. A non-empty enc compresses the file with that encoding, a
+// non-nil dataKey encrypts it.
+func (s *server) write(id string, rdr io.Reader, limit int64, enc string, dataKey []byte) (string, int64, error) {
+	if limit >= 0 {
+		rdr = io.LimitReader(rdr, limit+1)
 	}
 
-	path := filepath.Join(dir, name)
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	key, err := tempKey(id)
 	if err != nil {
-		return err
+		return "", 0, err
+	}
+
+	w, err := s.createFile(key, dataKey)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var dst io.Writer = w
+	var zw io.WriteCloser
+	if enc != "" {
+		if zw, err = newEncoder(enc, w); err != nil {
+			w.abort()
+			return "", 0, err
+		}
+		dst = zw
+	}
+
+	n, err := io.Copy(dst, rdr)
+	if err == nil && limit >= 0 && n > limit {
+		err = errLimit
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		w.abort()
+		return "", n, err
+	}
+
+	if err := w.commit(); err != nil {
+		return "", n, err
+	}
+
+	return key, n, nil
+}
+
+// place renames the written object tmp to name in token id. It is called
+// from within the bolt transaction that records the file, a token thus
+// only ever lists complete files.
+func (s *server) place(tmp, id, name string) error {
+	return s.files.rename(tmp, path.Join(id, name))
+}
+
+// migrate turns the file of every legacy token into its first file, sized
+// from the storage. It must run before the server accepts requests. A
+// legacy token whose file is gone keeps no files.
+func (s *server) migrate() (int, error) {
+	names, err := s.database.legacy()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for id, name := range names {
+		size, err := s.stat(path.Join(hex.EncodeToString([]byte(id)), name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("migrate %x: %v", id, err)
+			continue
+		}
+
+		if _, err := s.modify([]byte(id), func(t *tokenshare.Token) error {
+			if len(t.Files) == 0 {
+				t.Files = []tokenshare.FileInfo{{Name: name, Size: size, T: t.T}}
+			}
+			return nil
+		}); err != nil {
+			log.Printf("migrate %x: %v", id, err)
+			continue
+		}
+		n++
+	}
+
+	return n, nil
+}
+
+// stat returns the size of the stored object key.
+func (s *server) stat(key string) (int64, error) {
+	f, err := s.files.open(key)
+	if err != nil {
+		return 0, err
 	}
 	defer f.Close()
-	_, err = io.Copy(f, rdr)
-	return err
+
+	return f.size(), nil
 }
 
 func (s *server) checkAuth(req *http.Request) bool {
@@ -157,22 +309,135 @@ func (s *server) list(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	_, _ = w.Write(toks)
+	now := time.Now()
+	for i := range toks {
+		toks[i] = redact(toks[i], true, true)
+
+		// expired tokens linger until the reaper removes them
+		if toks[i].Expired(now) {
+			toks[i].Status = tokenshare.StatusExpired
+		}
+	}
+
+	buf, err := tokenshare.MarshalList(toks)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("marshal: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	_, _ = w.Write(buf)
 }
 
 func (s *server) single(w http.ResponseWriter, req *http.Request) {
-	id, err := hex.DecodeString(req.FormValue(tokenshare.ID))
-	if err != nil {
-		http.Error(w, fmt.Sprintf("hex decode: %v", err), http.StatusInternalServerError)
+	tok, _, ok := s.lookup(w, req.FormValue(tokenshare.ID))
+	if !ok {
+		return
 	}
 
-	tok, err := s.database.single(id)
+	// without passphrase a protected token is summarized, a wrong one is
+	// refused
+	full := s.unlocks(req, tok)
+	if !full && req.Header.Get(tokenshare.PassphraseHeader) != "" {
+		http.Error(w, tokenshare.WrongPassphrase{}.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	buf, err := tokenshare.Marshal(redact(tok, full, s.checkCookie(req)))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("marshal: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	_, _ = w.Write(tok)
+	_, _ = w.Write(buf)
+}
+
+// unlocks reports whether req may access tok: the token is not protected,
+// req carries the right passphrase or comes from the admin.
+func (s *server) unlocks(req *http.Request, tok tokenshare.Token) bool {
+	if !tok.Protected || s.checkCookie(req) {
+		return true
+	}
+
+	passphrase := req.Header.Get(tokenshare.PassphraseHeader)
+	return bcrypt.CompareHashAndPassword(tok.Hash, []byte(passphrase)) == nil
+}
+
+// authorize is unlocks, but writes an error response if access is denied.
+func (s *server) authorize(w http.ResponseWriter, req *http.Request, tok tokenshare.Token) bool {
+	if !s.unlocks(req, tok) {
+		http.Error(w, tokenshare.WrongPassphrase{}.Error(), http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+// redact strips the passphrase hash from tok. Unless full is set, all
+// metadata of a protected token is stripped as well. The bookkeeping of
+// the admin is only kept for the admin.
+func redact(tok tokenshare.Token, full, admin bool) tokenshare.Token {
+	tok.Hash = nil
+	tok.DataKey, tok.KeyID = nil, ""
+	tok.Resumes = nil
+	if !admin {
+		tok.Label, tok.Recipient, tok.Owner = "", "", ""
+		if !tok.ShowNote {
+			tok.Note = ""
+		}
+	}
+	if full || !tok.Protected {
+		return tok
+	}
+
+	return tokenshare.Token{
+		ID:        tok.ID,
+		Code:      tok.Code,
+		T:         tok.T,
+		Expires:   tok.Expires,
+		Kind:      tok.Kind,
+		Protected: true,
+	}
+}
+
+// lookup decodes id and fetches the matching token. It reports false after
+// writing an error response if the token does not exist or has expired.
+func (s *server) lookup(w http.ResponseWriter, id string) (tokenshare.Token, []byte, bool) {
+	bid, err := s.decode(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode id: %v", err), http.StatusBadRequest)
+		return tokenshare.Token{}, nil, false
+	}
+
+	tok, ok, err := s.database.poke(bid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("database: %v", err), http.StatusInternalServerError)
+		return tokenshare.Token{}, nil, false
+	}
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such token: %s", id), http.StatusBadRequest)
+		return tokenshare.Token{}, nil, false
+	}
+
+	if tok.State() == tokenshare.StatusRevoked {
+		http.Error(w, fmt.Sprintf("%v: %s", tokenshare.TokenRevoked{}, id), http.StatusGone)
+		return tokenshare.Token{}, nil, false
+	}
+
+	if tok.State() == tokenshare.StatusExpired || tok.Expired(time.Now()) {
+		if tok.State() != tokenshare.StatusExpired {
+			if _, err := s.modify(bid, func(t *tokenshare.Token) error {
+				return transition(t, tokenshare.StatusExpired)
+			}); err != nil {
+				log.Printf("expire %s: %v", id, err)
+			}
+		}
+
+		http.Error(w, fmt.Sprintf("%v: %s", tokenshare.TokenExpired{}, id), http.StatusGone)
+		return tokenshare.Token{}, nil, false
+	}
+
+	return tok, bid, true
 }
 
 func (s *server) create(w http.ResponseWriter, req *http.Request) {
@@ -181,13 +446,22 @@ func (s *server) create(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	tok, err := s.generate()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("generate: %v", err), http.StatusInternalServerError)
+	if err := req.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("parse form: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	tok, ok := s.newToken(w, req.Form, req.Header.Get(tokenshare.PassphraseHeader), tokenshare.KindRequest)
+	if !ok {
+		return
+	}
+
+	if err := s.insert(&tok); err != nil {
+		http.Error(w, fmt.Sprintf("insert: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	buf, err := tokenshare.Marshal(tok)
+	buf, err := tokenshare.Marshal(redact(tok, true, true))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("marhsal: %v", err), http.StatusInternalServerError)
 		return
@@ -196,6 +470,161 @@ func (s *server) create(w http.ResponseWriter, req *http.Request) {
 	_, _ = w.Write(buf)
 }
 
+// newToken builds a token of the given kind with the options in form,
+// protected by passphrase if it is not empty. It reports false after
+// writing an error response if an option is invalid.
+func (s *server) newToken(w http.ResponseWriter, form url.Values, passphrase string, kind tokenshare.Kind) (tokenshare.Token, bool) {
+	tok, err := s.new()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("generate: %v", err), http.StatusInternalServerError)
+		return tokenshare.Token{}, false
+	}
+	tok.Kind = kind
+	tok.Status = tokenshare.StatusCreated
+	tok.Owner = s.user
+
+	if err := options(form, passphrase, &tok); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return tokenshare.Token{}, false
+	}
+
+	return tok, true
+}
+
+// options applies the creation options in form and the passphrase to tok.
+func options(form url.Values, passphrase string, tok *tokenshare.Token) error {
+	if ttl := form.Get(tokenshare.TTL); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid ttl: %s", ttl)
+		}
+		tok.Expires = tok.T.Add(d)
+	}
+
+	maxFiles, err := formInt(form, tokenshare.MaxFiles)
+	if err != nil {
+		return err
+	}
+	tok.MaxFiles = int(maxFiles)
+
+	if tok.MaxBytes, err = formInt(form, tokenshare.MaxBytes); err != nil {
+		return err
+	}
+
+	if tok.MaxSize, err = formInt(form, tokenshare.MaxSize); err != nil {
+		return err
+	}
+
+	maxDownloads, err := formInt(form, tokenshare.MaxDownloads)
+	if err != nil {
+		return err
+	}
+	tok.MaxDownloads = int(maxDownloads)
+
+	tok.Label = form.Get(tokenshare.Label)
+	tok.Recipient = form.Get(tokenshare.Recipient)
+	tok.Note = form.Get(tokenshare.Note)
+	tok.ShowNote = form.Get(tokenshare.ShowNote) == "true"
+
+	if passphrase != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passphrase), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+
+		tok.Protected = true
+		tok.Hash = hash
+	}
+
+	return nil
+}
+
+func (s *server) delete(w http.ResponseWriter, req *http.Request) {
+	// a GET could be triggered by any page the admin visits, by an image
+	// for instance
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.checkCookie(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := req.FormValue(tokenshare.ID)
+	bid, err := s.decode(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode id: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	_, ok, err := s.database.poke(bid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("database: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such token: %s", id), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.purge(bid); err != nil {
+		http.Error(w, fmt.Sprintf("delete: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// revoke invalidates a token and removes its files, but keeps its record so
+// that its links report the revocation.
+func (s *server) revoke(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.checkCookie(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id := req.FormValue(tokenshare.ID)
+	bid, err := s.decode(id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("decode id: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := s.modify(bid, func(t *tokenshare.Token) error {
+		return transition(t, tokenshare.StatusRevoked)
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("revoke: %v", err), code(err))
+		return
+	}
+
+	if err := s.clear(bid); err != nil {
+		http.Error(w, fmt.Sprintf("revoke: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// formInt parses the non-negative integer form value key. A missing value
+// yields zero.
+func formInt(form url.Values, key string) (int64, error) {
+	v := form.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", key, v)
+	}
+
+	return n, nil
+}
+
 func (s *server) file(w http.ResponseWriter, path, name string, contentType string) {
 	file, err := ioutil.ReadFile(filepath.Join(path, name))
 	if err != nil {
@@ -210,71 +639,597 @@ func (s *server) file(w http.ResponseWriter, path, name string, contentType stri
 func (s *server) upload(w http.ResponseWriter, req *http.Request) {
 	s.file(w, s.static, upload, "text/html; charset-utf-8")
 }
+
+func (s *server) receive(w http.ResponseWriter, req *http.Request) {
+	s.file(w, s.static, receive, "text/html; charset-utf-8")
+}
+
 func (s *server) transfer(w http.ResponseWriter, req *http.Request) {
-	if err := req.ParseMultipartForm(s.maxMemory); err != nil {
-		http.Error(w, fmt.Sprintf("parse multipart form: %v", err), http.StatusBadGateway)
+	// the token is looked up from the query, before any of the body is
+	// read. Older clients send it as form field ahead of the file.
+	var part *multipart.Part
+	id := req.URL.Query().Get(tokenshare.ID)
+	if id == "" {
+		var ok bool
+		if part, id, ok = s.formFile(w, req, 0); !ok {
+			return
+		}
+		defer part.Close()
 	}
 
-	if req.MultipartForm == nil {
-		http.Error(w, "no multipart form", http.StatusBadRequest)
+	token, bid, ok := s.lookup(w, id)
+	if !ok {
 		return
 	}
 
-	id := req.FormValue(tokenshare.ID)
-	bid, err := hex.DecodeString(id)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("hex decode: %v", err), http.StatusBadRequest)
+	if !s.authorize(w, req, token) {
+		return
 	}
 
-	token, ok, err := s.poke(bid)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to view database: %v", err), http.StatusInternalServerError)
+	if token.Kind == tokenshare.KindShare {
+		http.Error(w, "token does not accept uploads", http.StatusForbidden)
 		return
 	}
+
+	token, release, ok := s.exclusive(w, req, bid)
 	if !ok {
-		http.Error(w, fmt.Sprintf("no such token: %s", id), http.StatusBadRequest)
+		return
 	}
+	defer release()
 
-	file, handler, err := req.FormFile(tokenshare.File)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("unable to open form file: %v", err), http.StatusInternalServerError)
+	if token.Exhausted() {
+		http.Error(w, tokenshare.DownloadLimit{}.Error(), http.StatusGone)
 		return
 	}
-	defer file.Close()
 
-	if err := s.write(handler.Filename, id, file); err != nil {
-		http.Error(w, fmt.Sprintf("unable to write file: %v", err), http.StatusInternalServerError)
+	if !s.admit(w, token, req.ContentLength) {
 		return
 	}
 
-	token.Name = handler.Filename
+	if part != nil {
+		s.save(w, req, bid, token, part.FileName(), part)
+		return
+	}
+
+	s.store(w, req, bid, token)
+}
 
-	if err := s.update(bid, token); err != nil {
-		http.Error(w, fmt.Sprintf("unable to update token satus: %v", err), http.StatusInternalServerError)
+// put stores the request body as a file of the token, for clients that
+// cannot build multipart forms:
+//
+//	curl -T report.pdf https://host/t/<id>/report.pdf
+func (s *server) put(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, tokenshare.ReqPut), "/", 2)
+	if len(parts) != 2 {
+		http.Error(w, fmt.Sprintf("expected %s<id>/<name>", tokenshare.ReqPut), http.StatusBadRequest)
+		return
+	}
+
+	token, bid, ok := s.lookup(w, parts[0])
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, req, token) {
+		return
+	}
+
+	if token.Kind == tokenshare.KindShare {
+		http.Error(w, "token does not accept uploads", http.StatusForbidden)
+		return
+	}
+
+	token, release, ok := s.exclusive(w, req, bid)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if token.Exhausted() {
+		http.Error(w, tokenshare.DownloadLimit{}.Error(), http.StatusGone)
+		return
+	}
+
+	if token.MaxSize > 0 {
+		if req.ContentLength > token.MaxSize {
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", token.MaxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, token.MaxSize)
+	}
+
+	if !s.admit(w, token, req.ContentLength) {
+		return
+	}
+
+	s.save(w, req, bid, token, parts[1], req.Body)
 }
 
-func (s *server) download(w http.ResponseWriter, req *http.Request) {
-	id := req.FormValue(tokenshare.ID)
+// share creates a token of kind share and stores the file uploaded by the
+// admin with it. The token is removed again if the upload fails.
+func (s *server) share(w http.ResponseWriter, req *http.Request) {
+	if !s.checkCookie(req) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// options are read from the query only, the body holds the upload
+	tok, ok := s.newToken(w, req.URL.Query(), req.Header.Get(tokenshare.PassphraseHeader), tokenshare.KindShare)
+	if !ok {
+		return
+	}
+
+	if !s.admit(w, tok, req.ContentLength) {
+		return
+	}
+
+	if err := s.insert(&tok); err != nil {
+		http.Error(w, fmt.Sprintf("insert: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	stored, ok := s.store(w, req, tok.ID, tok)
+	if !ok {
+		if err := s.purge(tok.ID); err != nil {
+			log.Printf("purge %s: %v", hex.EncodeToString(tok.ID), err)
+		}
+		return
+	}
+	tok = stored
 
-	bid, err := hex.DecodeString(id)
+	buf, err := tokenshare.Marshal(redact(tok, true, true))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("hex decode: %v", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("marhsal: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	tok, ok, err := s.database.poke(bid)
+	_, _ = w.Write(buf)
+}
+
+// store streams the file of the multipart upload in req to the token and
+// returns the updated token. The body is read part by part, the file is
+// written to its final location without being buffered first. It reports
+// false after writing an error response.
+func (s *server) store(w http.ResponseWriter, req *http.Request, bid []byte, token tokenshare.Token) (tokenshare.Token, bool) {
+	if token.MaxSize > 0 {
+		limit := token.MaxSize + multipartOverhead
+		if req.ContentLength > limit {
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", token.MaxSize), http.StatusRequestEntityTooLarge)
+			return tokenshare.Token{}, false
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, limit)
+	}
+
+	part, _, ok := s.formFile(w, req, token.MaxSize)
+	if !ok {
+		return tokenshare.Token{}, false
+	}
+	defer part.Close()
+
+	return s.save(w, req, bid, token, part.FileName(), part)
+}
+
+// formFile advances the multipart body of req to its file part and returns
+// it with the id field sent ahead of it, if any. maxSize is the limit of
+// the token that is reported if the body is too large. It reports false
+// after writing an error response.
+func (s *server) formFile(w http.ResponseWriter, req *http.Request, maxSize int64) (*multipart.Part, string, bool) {
+	mr, err := req.MultipartReader()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("database: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("no multipart form: %v", err), http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	part, id, err := s.filePart(mr)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errLimit):
+			http.Error(w, fmt.Sprintf("form fields exceed %d bytes", s.maxMemory), http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, fmt.Sprintf("unable to read form file: %v", err), http.StatusBadRequest)
+		}
+		return nil, "", false
+	}
+
+	return part, id, true
+}
+
+// save streams the upload of the file name from rdr to the token, checking
+// its limits and the digest from the query, and returns the updated token.
+// It reports false after writing an error response.
+func (s *server) save(w http.ResponseWriter, req *http.Request, bid []byte, token tokenshare.Token, name string, rdr io.Reader) (tokenshare.Token, bool) {
+	id := hex.EncodeToString(bid)
+
+	name, err := sanitize(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return tokenshare.Token{}, false
+	}
+	name = unique(token, name)
+
+	e2e, err := tokenshare.ParseE2E(req.URL.Query().Get(tokenshare.Encryption))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return tokenshare.Token{}, false
+	}
+
+	// the size is not known before the file has been read, the file
+	// count is checked up front and the byte limits while streaming
+	if err := token.Add(tokenshare.FileInfo{Name: name}); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return tokenshare.Token{}, false
+	}
+
+	limit := int64(-1)
+	if token.MaxSize > 0 {
+		limit = token.MaxSize
+	}
+	prev, _ := token.File(name)
+	if token.MaxBytes > 0 {
+		room := token.MaxBytes - (token.Size() - prev.Size)
+		if limit < 0 || room < limit {
+			limit = room
+		}
+	}
+
+	// the file it replaces is given up, the size of chunked uploads is
+	// only known once they are read
+	quota, err := s.room(token)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("usage: %v", err), http.StatusInternalServerError)
+		return tokenshare.Token{}, false
+	}
+	if quota >= 0 {
+		quota += prev.Size
+		if limit < 0 || quota < limit {
+			limit = quota
+		}
+	}
+
+	if _, err := s.modify(bid, func(t *tokenshare.Token) error {
+		return transition(t, tokenshare.StatusUploading)
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("unable to start upload: %v", err), code(err))
+		return tokenshare.Token{}, false
+	}
+
+	complete := false
+	defer func() {
+		if complete {
+			return
+		}
+
+		if _, err := s.modify(bid, settle); err != nil {
+			log.Printf("settle %s: %v", id, err)
+		}
+	}()
+
+	dataKey, err := s.fileKey(bid)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("data key: %v", err), http.StatusInternalServerError)
+		return tokenshare.Token{}, false
+	}
+
+	h := sha256.New()
+	enc := s.encoding(name, e2e)
+	tmp, n, err := s.write(id, io.TeeReader(rdr, h), limit, enc, dataKey)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge), errors.Is(err, errLimit) && token.MaxSize > 0 && n > token.MaxSize:
+			http.Error(w, fmt.Sprintf("upload exceeds %d bytes", token.MaxSize), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, errLimit) && quota >= 0 && n > quota:
+			http.Error(w, fmt.Sprintf("%v: %d bytes left", tokenshare.QuotaExceeded{}, quota), code(tokenshare.QuotaExceeded{}))
+		case errors.Is(err, errLimit):
+			http.Error(w, tokenshare.TokenFull{}.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, fmt.Sprintf("unable to write file: %v", err), http.StatusInternalServerError)
+		}
+		return tokenshare.Token{}, false
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if want := req.URL.Query().Get(tokenshare.SHA256); want != "" && !strings.EqualFold(want, sum) {
+		_ = s.files.remove(tmp)
+		http.Error(w, fmt.Sprintf("%v: received %s", tokenshare.ChecksumMismatch{}, sum), http.StatusUnprocessableEntity)
+		return tokenshare.Token{}, false
+	}
+
+	if e2e != nil {
+		if err := e2e.Check(n); err != nil {
+			_ = s.files.remove(tmp)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return tokenshare.Token{}, false
+		}
+	}
+
+	// the limits are checked again, a concurrent upload might have
+	// claimed the remaining space in the meantime
+	info := tokenshare.FileInfo{Name: name, Size: n, T: time.Now(), SHA256: sum, Encoding: enc, Encrypted: dataKey != nil, E2E: e2e}
+	token, err = s.record(bid, tmp, info, dataKey, nil)
+	if err != nil {
+		_ = s.files.remove(tmp)
+		http.Error(w, fmt.Sprintf("unable to update token satus: %v", err), code(err))
+		return tokenshare.Token{}, false
+	}
+
+	complete = true
+	return token, true
+}
+
+// filePart advances mr to the file part of the upload and returns it with
+// the value of the id part before it. Other parts are discarded, at most
+// maxMemory bytes of them are read.
+func (s *server) filePart(mr *multipart.Reader) (*multipart.Part, string, error) {
+	var id string
+	budget := s.maxMemory
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", http.ErrMissingFile
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		if part.FormName() == tokenshare.File && part.FileName() != "" {
+			return part, id, nil
+		}
+
+		var dst io.Writer = ioutil.Discard
+		value := &bytes.Buffer{}
+		if part.FormName() == tokenshare.ID {
+			dst = value
+		}
+
+		n, err := io.Copy(dst, io.LimitReader(part, budget+1))
+		part.Close()
+		if err != nil {
+			return nil, "", err
+		}
+
+		budget -= n
+		if budget < 0 {
+			return nil, "", errLimit
+		}
+
+		if part.FormName() == tokenshare.ID {
+			id = value.String()
+		}
+	}
+}
+
+func (s *server) download(w http.ResponseWriter, req *http.Request) {
+	id := req.FormValue(tokenshare.ID)
+	tok, bid, ok := s.lookup(w, id)
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, req, tok) {
 		return
 	}
 
+	if format := req.FormValue(tokenshare.Format); format != "" {
+		s.archive(w, tok, bid, tokenshare.Archive(format))
+		return
+	}
+
+	name := req.FormValue(tokenshare.Name)
+	if name == "" && len(tok.Files) == 1 {
+		name = tok.Files[0].Name
+	}
+
+	if name == "" {
+		http.Error(w, fmt.Sprintf("%s required, token holds %d files", tokenshare.Name, len(tok.Files)), http.StatusBadRequest)
+		return
+	}
+
+	info, ok := tok.File(name)
 	if !ok {
-		http.Error(w, fmt.Sprintf("no such token: %s", id), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("no such file: %s", name), http.StatusNotFound)
+		return
+	}
+
+	// the file is opened before the download is counted, so it stays
+	// readable even if a concurrent download purges the storage
+	key, dataKey, err := s.locate(tok, info)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("data key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var f object
+	if err == nil {
+		f, err = s.openFile(key, dataKey)
+	}
+	if errors.Is(err, fs.ErrNotExist) && tok.Exhausted() {
+		http.Error(w, tokenshare.DownloadLimit{}.Error(), http.StatusGone)
 		return
 	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("open: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// compressed files are passed through if the client can decode them,
+	// range requests are always served from the decoded file
+	size := f.size()
+	if info.Encoding != "" && (req.Header.Get("Range") != "" || !accepts(req.Header.Get("Accept-Encoding"), info.Encoding)) {
+		size = info.Size
+	}
+
+	// every request counts as a download, unless it continues an
+	// interrupted one, so that a download-once link can still be resumed.
+	// A range beyond the end of the file is refused without counting, a
+	// HEAD request sends nothing.
+	head := req.Method == http.MethodHead
+	start, rest := rangeStart(req, f.modTime())
+	if !head && (start < size || size == 0) {
+		tok, err = s.countFrom(bid, name, start, rest)
+		if err != nil {
+			http.Error(w, err.Error(), code(err))
+			return
+		}
+	}
 
-	w.Header().Set("content-disposition", fmt.Sprintf(`attachment; filename="%s"`, tok.Name))
-	http.ServeFile(w, req, filepath.Join(s.storage, id, tok.Name))
+	// the progress is recorded even if the connection drops
+	sw := &sizeWriter{ResponseWriter: w}
+	defer func() {
+		if sw.n > 0 {
+			s.progress(bid, name, start+sw.n, start+sw.n >= size)
+		}
+	}()
+	w.Header().Set("content-disposition", disposition(name))
+
+	if info.Encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if req.Header.Get("Range") == "" && accepts(req.Header.Get("Accept-Encoding"), info.Encoding) {
+			passthrough(sw, req, name, info.Encoding, f)
+		} else {
+			d := &decoded{f: f, enc: info.Encoding, size: info.Size}
+			defer d.Close()
+
+			http.ServeContent(sw, req, name, f.modTime(), d)
+		}
+	} else {
+		http.ServeContent(sw, req, name, f.modTime(), f)
+	}
+
+	// the files are kept until the last download was sent in full
+	if !head && tok.Exhausted() && start+sw.n >= size {
+		if err := s.release(bid); err != nil {
+			log.Printf("purge %s: %v", id, err)
+		}
+	}
+}
+
+// passthrough sends the stored bytes of a compressed file with their
+// Content-Encoding.
+func passthrough(w http.ResponseWriter, req *http.Request, name, enc string, f object) {
+	ctype := mime.TypeByExtension(filepath.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", enc)
+	w.Header().Set("Content-Length", strconv.FormatInt(f.size(), 10))
+	w.Header().Set("Last-Modified", f.modTime().UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	if _, err := io.Copy(w, f); err != nil {
+		log.Printf("download %s: %v", name, err)
+	}
+}
+
+// rangeStart returns the offset a download of a file modified at mod is
+// served from and whether the rest of the file from there is asked for. It
+// is zero unless req asks for a single range that starts later in the
+// file, with a matching If-Range validator if one is given.
+func rangeStart(req *http.Request, mod time.Time) (int64, bool) {
+	spec := req.Header.Get("Range")
+	if !strings.HasPrefix(spec, "bytes=") || strings.Contains(spec, ",") {
+		return 0, true
+	}
+
+	if ir := req.Header.Get("If-Range"); ir != "" {
+		t, err := http.ParseTime(ir)
+		if err != nil || !mod.Truncate(time.Second).Equal(t) {
+			return 0, true
+		}
+	}
+
+	bounds := strings.SplitN(strings.TrimPrefix(spec, "bytes="), "-", 2)
+	start, err := strconv.ParseInt(strings.TrimSpace(bounds[0]), 10, 64)
+	if err != nil || start < 0 || len(bounds) != 2 {
+		return 0, true
+	}
+
+	return start, strings.TrimSpace(bounds[1]) == ""
+}
+
+// sizeWriter counts the bytes of the response body.
+type sizeWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// resumeSlack is how far before the recorded offset of an interrupted
+// download its continuation may start, as the client may not have
+// received all bytes the server sent. The bytes within are the only ones a
+// client gets more than once without counting a download.
+const resumeSlack = 8 << 20
+
+// count records a download of the token, failing once its download limit
+// has been reached.
+func (s *server) count(bid []byte) (tokenshare.Token, error) {
+	return s.modify(bid, countDownload)
+}
+
+// countFrom is count for a download of the file name from start. The
+// continuation of an interrupted download is free: it asks for the rest of
+// the file from about where the interrupted download stopped.
+func (s *server) countFrom(bid []byte, name string, start int64, rest bool) (tokenshare.Token, error) {
+	return s.modify(bid, func(t *tokenshare.Token) error {
+		r, ok := t.Resumption(name)
+		if ok && rest && start > 0 && start >= r.Offset-resumeSlack {
+			return nil
+		}
+
+		return countDownload(t)
+	})
+}
+
+func countDownload(t *tokenshare.Token) error {
+	if t.Exhausted() {
+		return tokenshare.DownloadLimit{}
+	}
+
+	if err := transition(t, tokenshare.StatusDownloaded); err != nil {
+		return err
+	}
+
+	t.Downloads++
+	return nil
+}
+
+// progress records that a download of the file name was sent up to
+// offset, it may be continued from there unless it is done.
+func (s *server) progress(bid []byte, name string, offset int64, done bool) {
+	if _, err := s.modify(bid, func(t *tokenshare.Token) error {
+		if done {
+			t.DropResumption(name)
+			return nil
+		}
+
+		if r, ok := t.Resumption(name); ok && r.Offset > offset {
+			return nil
+		}
+
+		t.SetResumption(tokenshare.Resumption{Name: name, Offset: offset})
+		return nil
+	}); err != nil {
+		log.Printf("download %s: %v", name, err)
+	}
 }
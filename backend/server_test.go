@@ -1,20 +1,32 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/jostillmanns/tokenshare"
 )
 
@@ -22,7 +34,7 @@ func TestCreate(t *testing.T) {
 	server, testSrv, cookie, close := newTestServer(t)
 	defer close()
 
-	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie)
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
 	if err != nil {
 		t.Fatalf("create: %v", err)
 	}
@@ -59,6 +71,7 @@ func TestTransfer(t *testing.T) {
 		testSrv.URL+tokenshare.ReqTransfer,
 		name,
 		id,
+		"",
 		buf,
 		nil,
 	); err != nil {
@@ -76,6 +89,59 @@ func TestTransfer(t *testing.T) {
 	}
 }
 
+func TestTransferFormID(t *testing.T) {
+	server, testSrv, _, close := newTestServer(t)
+	defer close()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := []byte("form id")
+
+	post := func(fields func(mw *multipart.Writer)) int {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		fields(mw)
+		_ = mw.Close()
+
+		resp, err := http.Post(testSrv.URL+tokenshare.ReqTransfer, mw.FormDataContentType(), body)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// an id after the file part is not known when the file is read
+	if code := post(func(mw *multipart.Writer) {
+		fw, _ := mw.CreateFormFile(tokenshare.File, "foo")
+		_, _ = fw.Write(buf)
+		_ = mw.WriteField(tokenshare.ID, id)
+	}); code == http.StatusOK {
+		t.Errorf("id after file: status %d", code)
+	}
+
+	if code := post(func(mw *multipart.Writer) {
+		_ = mw.WriteField(tokenshare.ID, id)
+		fw, _ := mw.CreateFormFile(tokenshare.File, "foo")
+		_, _ = fw.Write(buf)
+	}); code != http.StatusOK {
+		t.Fatalf("id before file: status %d", code)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("%q != %q", res, buf)
+	}
+}
+
 func TestList(t *testing.T) {
 	server, testSrv, cookie, close := newTestServer(t)
 	defer close()
@@ -114,7 +180,7 @@ func TestDownload(t *testing.T) {
 
 	buf := []byte("GREETING")
 	dir := filepath.Join(server.storage, hex.EncodeToString(tok.ID))
-	tok.Name = "foo"
+	tok.Files = []tokenshare.FileInfo{{Name: "foo", Size: int64(len(buf))}}
 
 	if err := server.database.update(tok.ID, tok); err != nil {
 		t.Fatalf("update: %v", err)
@@ -124,11 +190,11 @@ func TestDownload(t *testing.T) {
 		t.Fatalf("mkdir: %v", err)
 	}
 
-	if err := ioutil.WriteFile(filepath.Join(dir, tok.Name), buf, 0600); err != nil {
+	if err := ioutil.WriteFile(filepath.Join(dir, tok.Files[0].Name), buf, 0600); err != nil {
 		t.Fatalf("write file: %v", err)
 	}
 
-	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, hex.EncodeToString(tok.ID))
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, hex.EncodeToString(tok.ID), "", "")
 	if err != nil {
 		t.Fatalf("download: %v", err)
 	}
@@ -138,6 +204,2178 @@ func TestDownload(t *testing.T) {
 	}
 }
 
+func TestExpiry(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if tok.Expires.IsZero() {
+		t.Fatalf("token without expiry: %v", tok)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	dir := filepath.Join(server.storage, id)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	if err := server.sweep(time.Now()); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	if _, ok, err := server.poke(tok.ID); err != nil || !ok {
+		t.Fatalf("token reaped before expiry: %v", err)
+	}
+
+	if err := server.sweep(tok.Expires.Add(time.Second)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	if _, ok, err := server.poke(tok.ID); err != nil || ok {
+		t.Errorf("token not reaped: %v", err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("storage not reaped: %v", err)
+	}
+}
+
+// brokenDriver fails to remove the directory broken.
+type brokenDriver struct {
+	driver
+	broken string
+}
+
+func (d brokenDriver) removeAll(dir string) error {
+	if dir == d.broken {
+		return fmt.Errorf("remove %s: broken", dir)
+	}
+
+	return d.driver.removeAll(dir)
+}
+
+func TestExpirySkipsBroken(t *testing.T) {
+	server, _, _, close := newTestServer(t)
+	defer close()
+
+	var toks []tokenshare.Token
+	for i := 0; i < 2; i++ {
+		tok, err := server.new()
+		if err != nil {
+			t.Fatalf("new: %v", err)
+		}
+
+		tok.Expires = time.Now().Add(-time.Minute)
+		if err := server.insert(&tok); err != nil {
+			t.Fatalf("insert: %v", err)
+		}
+		toks = append(toks, tok)
+	}
+
+	server.files = brokenDriver{server.files, hex.EncodeToString(toks[0].ID)}
+	if err := server.sweep(time.Now()); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	if _, ok, err := server.poke(toks[0].ID); err != nil || !ok {
+		t.Errorf("broken token reaped: %v", err)
+	}
+
+	if _, ok, err := server.poke(toks[1].ID); err != nil || ok {
+		t.Errorf("token not reaped: %v", err)
+	}
+}
+
+// fixedIDs hands out the same ID over and over.
+type fixedIDs struct {
+	hexIDs
+	id []byte
+}
+
+func (f fixedIDs) new() ([]byte, error) {
+	return f.id, nil
+}
+
+func TestIDCollision(t *testing.T) {
+	server, _, _, close := newTestServer(t)
+	defer close()
+
+	first, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	// a colliding token is stored under a new ID
+	second := tokenshare.Token{ID: first.ID, Code: first.Code, Label: "second"}
+	if err := server.insert(&second); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	if bytes.Equal(second.ID, first.ID) || second.Code != server.ids.encode(second.ID) {
+		t.Errorf("colliding token kept id %x", second.ID)
+	}
+
+	stored, ok, err := server.poke(first.ID)
+	if err != nil || !ok || stored.Label != "" {
+		t.Errorf("token replaced: %v, %v", stored, err)
+	}
+
+	server.ids = fixedIDs{server.ids.(hexIDs), first.ID}
+	if _, err := server.generate(); err == nil {
+		t.Errorf("generated a token in a used up id space")
+	}
+}
+
+func TestExpired(t *testing.T) {
+	server, testSrv, _, close := newTestServer(t)
+	defer close()
+
+	tok, err := server.new()
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	tok.Expires = time.Now().Add(-time.Minute)
+	if err := server.insert(&tok); err != nil {
+		t.Fatalf("insert: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "", ""); err == nil {
+		t.Errorf("download of expired token succeeded")
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", []byte("foo"), nil); err == nil {
+		t.Errorf("transfer to expired token succeeded")
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	// tokens held a single file, whose name was kept in the token
+	tok, err := server.new()
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+
+	buf, err := json.Marshal(map[string]interface{}{"id": tok.ID, "t": time.Now(), "name": "report.pdf"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+
+	if err := server.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(server.bucket)).Put(tok.ID, buf)
+	}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	if err := os.Mkdir(filepath.Join(server.storage, id), 0700); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(server.storage, id, "report.pdf"), []byte("REPORT"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if n, err := server.migrate(); err != nil || n != 1 {
+		t.Fatalf("migrate: %d, %v", n, err)
+	}
+
+	toks, err := tokenshare.List(testSrv.URL+tokenshare.ReqList, cookie)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(toks) != 1 || len(toks[0].Files) != 1 || toks[0].Files[0].Name != "report.pdf" || toks[0].Files[0].Size != 6 || toks[0].State() != tokenshare.StatusComplete {
+		t.Fatalf("unexpected list: %v", toks)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "", "")
+	if err != nil || string(res) != "REPORT" {
+		t.Errorf("download: %q, %v", res, err)
+	}
+}
+
+func TestMultiFile(t *testing.T) {
+	_, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxFiles: 2, MaxBytes: 10})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	files := map[string][]byte{"foo": []byte("FOO"), "bar": []byte("BAR")}
+
+	for name, buf := range files {
+		if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, name, id, "", buf, nil); err != nil {
+			t.Fatalf("transfer: %v", err)
+		}
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "baz", id, "", []byte("BAZ"), nil); err == nil {
+		t.Errorf("transfer beyond file limit succeeded")
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", []byte("FOOFOOFOO"), nil); err == nil {
+		t.Errorf("transfer beyond byte limit succeeded")
+	}
+
+	toks, err := tokenshare.List(testSrv.URL+tokenshare.ReqList, cookie)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(toks) != 1 || len(toks[0].Files) != 2 {
+		t.Fatalf("unexpected list: %v", toks)
+	}
+
+	for name, buf := range files {
+		res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, name, "")
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+
+		if !bytes.Equal(res, buf) {
+			t.Errorf("%s != %s", string(res), string(buf))
+		}
+	}
+}
+
+// cutWriter aborts the response after limit bytes.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		_, _ = w.ResponseWriter.Write(p[:w.limit])
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestResumeDownload(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	// the first response is cut off after 100 KiB
+	var once sync.Once
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		once.Do(func() {
+			w = &cutWriter{w, 100 * 1024}
+		})
+		server.mux.ServeHTTP(w, req)
+	}))
+	defer flaky.Close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := make([]byte, 1024*1024)
+	for i := range buf {
+		buf[i] = byte(i % 251)
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	var last int64
+	res := &bytes.Buffer{}
+	n, err := tokenshare.DownloadTo(flaky.URL+tokenshare.ReqDownload, id, "foo", "", res, func(n int64) { last = n })
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if n != int64(len(buf)) || last != n || !bytes.Equal(res.Bytes(), buf) {
+		t.Errorf("resumed download differs: %d bytes, progress %d", n, last)
+	}
+
+	// the interrupted download-once link was counted a single time, its
+	// file is gone once it was sent in full
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if stored.Downloads != 1 {
+		t.Errorf("downloads %d, want 1", stored.Downloads)
+	}
+
+	if _, err := os.Stat(filepath.Join(server.storage, id)); !os.IsNotExist(err) {
+		t.Errorf("storage not purged: %v", err)
+	}
+
+	// a range request that continues no interrupted download is counted
+	other, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	oid := hex.EncodeToString(other.ID)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", oid, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	path := filepath.Join(server.storage, "partial")
+	if err := ioutil.WriteFile(path, buf[:1000], 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := tokenshare.DownloadFile(testSrv.URL+tokenshare.ReqDownload, oid, "foo", "", path, nil); err != nil {
+		t.Fatalf("download file: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(got, buf) {
+		t.Errorf("downloaded file differs: %v", err)
+	}
+
+	// a complete file is left alone
+	if err := tokenshare.DownloadFile(testSrv.URL+tokenshare.ReqDownload, oid, "foo", "", path, nil); err != nil {
+		t.Errorf("download complete file: %v", err)
+	}
+
+	if stored, _, err = server.poke(other.ID); err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if stored.Downloads != 1 {
+		t.Errorf("downloads %d, want 1", stored.Downloads)
+	}
+}
+
+func TestHeadDownload(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := []byte("GREETING")
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	resp, err := http.Head(testSrv.URL + tokenshare.ReqDownload + "?" + url.Values{tokenshare.ID: {id}}.Encode())
+	if err != nil {
+		t.Fatalf("head: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(buf)) {
+		t.Errorf("head: %s, %d bytes", resp.Status, resp.ContentLength)
+	}
+
+	// the HEAD request used up nothing
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if stored.Downloads != 0 {
+		t.Errorf("downloads %d, want 0", stored.Downloads)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "")
+	if err != nil || !bytes.Equal(res, buf) {
+		t.Errorf("download after head: %q, %v", res, err)
+	}
+}
+
+func TestRangeDownloads(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxDownloads: 2})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := bytes.Repeat([]byte("GREETING"), 1000)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	get := func(spec string) int {
+		req, err := http.NewRequest(http.MethodGet, testSrv.URL+tokenshare.ReqDownload+"?"+url.Values{tokenshare.ID: {id}}.Encode(), nil)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		req.Header.Set("Range", spec)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// ranges that leave out the first and last byte continue nothing
+	spec := fmt.Sprintf("bytes=1-%d", len(buf)-2)
+	for i := 0; i < 2; i++ {
+		if code := get(spec); code != http.StatusPartialContent {
+			t.Fatalf("range %d: %d", i, code)
+		}
+	}
+
+	if code := get(spec); code != http.StatusGone {
+		t.Errorf("range beyond the download limit: %d", code)
+	}
+
+	// the rest of the last, interrupted download is still free
+	if code := get(fmt.Sprintf("bytes=%d-", len(buf)-1)); code != http.StatusPartialContent {
+		t.Errorf("continuation: %d", code)
+	}
+
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if stored.Downloads != 2 || len(stored.Resumes) != 0 {
+		t.Errorf("unexpected token: %v", stored)
+	}
+
+	if _, err := os.Stat(filepath.Join(server.storage, id)); !os.IsNotExist(err) {
+		t.Errorf("storage not purged: %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	for _, enc := range []string{encGzip, encZstd} {
+		t.Run(enc, func(t *testing.T) {
+			server, testSrv, cookie, close := newTestServer(t)
+			defer close()
+			server.compress = enc
+
+			tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+
+			id := hex.EncodeToString(tok.ID)
+			buf := bytes.Repeat([]byte("2024-01-01 12:00:00 INFO request served\n"), 16*1024)
+			if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "server.log", id, "", buf, nil); err != nil {
+				t.Fatalf("transfer: %v", err)
+			}
+
+			if err := tokenshare.Resume(testSrv.URL+tokenshare.ReqResumable, "resumed.log", id, "", bytes.NewReader(buf), int64(len(buf)), nil); err != nil {
+				t.Fatalf("resume: %v", err)
+			}
+
+			if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "photo.jpg", id, "", buf[:100], nil); err != nil {
+				t.Fatalf("transfer: %v", err)
+			}
+
+			stored, _, err := server.poke(tok.ID)
+			if err != nil {
+				t.Fatalf("poke: %v", err)
+			}
+
+			sum := sha256.Sum256(buf)
+			for _, name := range []string{"server.log", "resumed.log"} {
+				f, ok := stored.File(name)
+				if !ok || f.Size != int64(len(buf)) || f.SHA256 != hex.EncodeToString(sum[:]) || f.Encoding != enc {
+					t.Errorf("unexpected file: %v", f)
+				}
+
+				stat, err := os.Stat(filepath.Join(server.storage, id, name))
+				if err != nil || stat.Size() >= int64(len(buf))/10 {
+					t.Errorf("%s not compressed: %v", name, err)
+				}
+			}
+
+			if f, _ := stored.File("photo.jpg"); f.Encoding != "" {
+				t.Errorf("compressed format compressed again: %v", f)
+			}
+
+			get := func(header http.Header) (*http.Response, []byte) {
+				req, err := http.NewRequest(http.MethodGet, testSrv.URL+tokenshare.ReqDownload+"?"+tokenshare.ID+"="+id+"&"+tokenshare.Name+"=server.log", nil)
+				if err != nil {
+					t.Fatalf("request: %v", err)
+				}
+				req.Header = header
+
+				resp, err := http.DefaultTransport.RoundTrip(req)
+				if err != nil {
+					t.Fatalf("get: %v", err)
+				}
+				defer resp.Body.Close()
+
+				res, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+
+				return resp, res
+			}
+
+			// passed through to clients that accept the encoding
+			resp, res := get(http.Header{"Accept-Encoding": {enc}})
+			if resp.Header.Get("Content-Encoding") != enc || len(res) >= len(buf)/10 {
+				t.Errorf("not passed through: %v, %d bytes", resp.Header, len(res))
+			}
+
+			dec, err := newDecoder(enc, bytes.NewReader(res))
+			if err != nil {
+				t.Fatalf("decoder: %v", err)
+			}
+			plain, err := ioutil.ReadAll(dec)
+			if err != nil || !bytes.Equal(plain, buf) {
+				t.Errorf("passed through file differs: %v", err)
+			}
+
+			// decoded for everybody else and for ranges
+			resp, res = get(http.Header{})
+			if resp.Header.Get("Content-Encoding") != "" || !bytes.Equal(res, buf) {
+				t.Errorf("decoded file differs: %v", resp.Header)
+			}
+
+			resp, res = get(http.Header{"Range": {"bytes=1000-1999"}, "Accept-Encoding": {enc}})
+			if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(res, buf[1000:2000]) {
+				t.Errorf("range differs: %s", resp.Status)
+			}
+
+			for _, name := range []string{"server.log", "resumed.log"} {
+				res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, name, "")
+				if err != nil || !bytes.Equal(res, buf) {
+					t.Errorf("download %s differs: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+	server.keys = testKeyring(t, "a")
+	server.compress = encGzip
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := make([]byte, tokenshare.ChunkSize*2+100)
+	for i := range buf {
+		buf[i] = byte(i * 7 % 253)
+	}
+	logs := bytes.Repeat([]byte("2024-01-01 12:00:00 INFO request served\n"), 16*1024)
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "data.bin", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	if err := tokenshare.Resume(testSrv.URL+tokenshare.ReqResumable, "resumed.bin", id, "", bytes.NewReader(buf), int64(len(buf)), nil); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "server.log", id, "", logs, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	for _, name := range []string{"data.bin", "resumed.bin", "server.log"} {
+		raw, err := ioutil.ReadFile(filepath.Join(server.storage, id, name))
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		if bytes.Contains(raw, buf[:64]) || bytes.Contains(raw, logs[:64]) {
+			t.Errorf("%s stored plainly", name)
+		}
+	}
+
+	// the data key never leaves the server
+	toks, err := tokenshare.List(testSrv.URL+tokenshare.ReqList, cookie)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(toks) != 1 || toks[0].DataKey != nil || toks[0].KeyID != "" || !toks[0].Files[0].Encrypted {
+		t.Errorf("unexpected list: %v", toks)
+	}
+
+	check := func() {
+		for name, want := range map[string][]byte{"data.bin": buf, "resumed.bin": buf, "server.log": logs} {
+			res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, name, "")
+			if err != nil || !bytes.Equal(res, want) {
+				t.Errorf("download %s differs: %v", name, err)
+			}
+		}
+
+		req, err := http.NewRequest(http.MethodGet, testSrv.URL+tokenshare.ReqDownload+"?"+tokenshare.ID+"="+id+"&"+tokenshare.Name+"=data.bin", nil)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		req.Header.Set("Range", "bytes=70000-140000")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		defer resp.Body.Close()
+
+		res, err := ioutil.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusPartialContent || !bytes.Equal(res, buf[70000:140001]) {
+			t.Errorf("range differs: %s, %v", resp.Status, err)
+		}
+	}
+	check()
+
+	// the master key is rotated without touching the files
+	server.keys = testKeyring(t, "b", "a")
+	if n, err := server.rewrap(); err != nil || n != 1 {
+		t.Fatalf("rewrap: %d, %v", n, err)
+	}
+
+	server.keys = testKeyring(t, "b")
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if stored.KeyID != "b" {
+		t.Errorf("wrapped with %s", stored.KeyID)
+	}
+	check()
+
+	// files stored with encryption cannot be read without it
+	server.keys = nil
+	if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "data.bin", ""); err == nil {
+		t.Errorf("download without master key succeeded")
+	}
+}
+
+func TestE2E(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+	server.compress = encGzip
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	id := hex.EncodeToString(tok.ID)
+
+	key, err := tokenshare.NewE2EKey()
+	if err != nil {
+		t.Fatalf("key: %v", err)
+	}
+
+	link := tokenshare.E2ELink(testSrv.URL+tokenshare.ReqReceive+"?id="+id, key)
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	if parsed, err := tokenshare.ParseE2EKey(u.Fragment); err != nil || !bytes.Equal(parsed, key) {
+		t.Errorf("key from %s: %v", link, err)
+	}
+
+	plain := bytes.Repeat([]byte("confidential notes\n"), 10000)
+	sealed, e, err := tokenshare.SealE2E(key, plain)
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	if err := tokenshare.ResumeE2E(testSrv.URL+tokenshare.ReqResumable, "notes.txt", id, "", bytes.NewReader(sealed), e, nil); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	// ciphertext is stored as it is, compression would not gain anything
+	f, ok := stored.File("notes.txt")
+	if !ok || f.E2E == nil || *f.E2E != e || f.Encoding != "" || f.Size != int64(len(sealed)) {
+		t.Errorf("unexpected file: %v", f)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(server.storage, id, "notes.txt"))
+	if err != nil || !bytes.Equal(raw, sealed) {
+		t.Errorf("stored file differs: %v", err)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "notes.txt", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	opened, err := tokenshare.OpenE2E(key, res, e)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Errorf("decrypted file differs: %v", err)
+	}
+
+	// chunks can neither be cut off nor reordered
+	chunk := tokenshare.E2EChunk + 16
+	cut := e
+	cut.Size = 2 * tokenshare.E2EChunk
+	if _, err := tokenshare.OpenE2E(key, res[:2*chunk], cut); err == nil {
+		t.Errorf("decrypted truncated file")
+	}
+
+	swapped := append(append([]byte{}, res[chunk:2*chunk]...), res[:chunk]...)
+	swapped = append(swapped, res[2*chunk:]...)
+	if _, err := tokenshare.OpenE2E(key, swapped, e); err == nil {
+		t.Errorf("decrypted reordered file")
+	}
+
+	if _, err := tokenshare.OpenE2E(bytes.Repeat([]byte{1}, 32), res, e); err == nil {
+		t.Errorf("decrypted with wrong key")
+	}
+
+	// parameters that do not match the upload are refused
+	other, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	id = hex.EncodeToString(other.ID)
+
+	put := func(e tokenshare.E2E, data []byte) int {
+		query := url.Values{tokenshare.Encryption: {e.Encode()}}
+		req, err := http.NewRequest(http.MethodPut, testSrv.URL+tokenshare.ReqPut+id+"/put.bin?"+query.Encode(), bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	sealed, e, err = tokenshare.SealE2E(key, plain[:1000])
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+
+	if code := put(e, sealed[:len(sealed)-1]); code != http.StatusBadRequest {
+		t.Errorf("put of short ciphertext: %d", code)
+	}
+
+	if code := put(e, sealed); code != http.StatusOK {
+		t.Errorf("put: %d", code)
+	}
+
+	bad := e
+	bad.Nonce = "short"
+	if err := tokenshare.ResumeE2E(testSrv.URL+tokenshare.ReqResumable, "bad.bin", id, "", bytes.NewReader(sealed), bad, nil); err == nil {
+		t.Errorf("resume with invalid nonce succeeded")
+	}
+}
+
+func TestArchive(t *testing.T) {
+	_, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	files := map[string][]byte{"foo": []byte("FOO"), "bar": bytes.Repeat([]byte("BAR"), 1024)}
+
+	for name, buf := range files {
+		if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, name, id, "", buf, nil); err != nil {
+			t.Fatalf("transfer: %v", err)
+		}
+	}
+
+	check := func(format tokenshare.Archive, got map[string][]byte) {
+		var manifest []tokenshare.ManifestEntry
+		if err := json.Unmarshal(got[tokenshare.ManifestName], &manifest); err != nil {
+			t.Fatalf("%s: manifest: %v", format, err)
+		}
+
+		if len(got) != len(files)+1 || len(manifest) != len(files) {
+			t.Fatalf("%s: unexpected archive: %v", format, manifest)
+		}
+
+		for _, e := range manifest {
+			sum := sha256.Sum256(files[e.Name])
+			if !bytes.Equal(got[e.Name], files[e.Name]) || e.Size != int64(len(files[e.Name])) || e.SHA256 != hex.EncodeToString(sum[:]) {
+				t.Errorf("%s: unexpected entry %v", format, e)
+			}
+		}
+	}
+
+	res, err := tokenshare.DownloadArchive(testSrv.URL+tokenshare.ReqDownload, id, tokenshare.ArchiveZip, "")
+	if err != nil {
+		t.Fatalf("download zip: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(res), int64(len(res)))
+	if err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+
+	got := make(map[string][]byte)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("zip open: %v", err)
+		}
+		got[f.Name], _ = ioutil.ReadAll(rc)
+		rc.Close()
+	}
+	check(tokenshare.ArchiveZip, got)
+
+	res, err = tokenshare.DownloadArchive(testSrv.URL+tokenshare.ReqDownload, id, tokenshare.ArchiveTarGz, "")
+	if err != nil {
+		t.Fatalf("download tar.gz: %v", err)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(res))
+	if err != nil {
+		t.Fatalf("gzip: %v", err)
+	}
+
+	got = make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar: %v", err)
+		}
+		got[hdr.Name], _ = ioutil.ReadAll(tr)
+	}
+	check(tokenshare.ArchiveTarGz, got)
+
+	if _, err := tokenshare.DownloadArchive(testSrv.URL+tokenshare.ReqDownload, id, "rar", ""); err == nil {
+		t.Errorf("download in unknown format succeeded")
+	}
+}
+
+func TestArchiveFailed(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxDownloads: 1})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", []byte("FOO"), nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	// the stored file is cut short, the archive cannot be completed
+	if err := os.Truncate(filepath.Join(server.storage, id, "foo"), 1); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	_, _ = tokenshare.DownloadArchive(testSrv.URL+tokenshare.ReqDownload, id, tokenshare.ArchiveZip, "")
+
+	if _, ok, err := server.poke(tok.ID); err != nil || !ok {
+		t.Fatalf("token purged after failed archive: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(server.storage, id, "foo")); err != nil {
+		t.Errorf("file released after failed archive: %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", []byte("FOO"), nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	if err := tokenshare.Delete(testSrv.URL+tokenshare.ReqDelete, nil, id); err == nil {
+		t.Errorf("unauthorized delete succeeded")
+	}
+
+	// destructive calls are refused as GET, even from the admin
+	for _, call := range []string{tokenshare.ReqDelete, tokenshare.ReqRevoke} {
+		req, err := http.NewRequest(http.MethodGet, testSrv.URL+call+"?"+url.Values{tokenshare.ID: {id}}.Encode(), nil)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		req.AddCookie(cookie)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s: %s", call, resp.Status)
+		}
+	}
+
+	if _, ok, err := server.poke(tok.ID); err != nil || !ok {
+		t.Fatalf("token gone after GET: %v", err)
+	}
+
+	if err := tokenshare.Delete(testSrv.URL+tokenshare.ReqDelete, cookie, id); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if _, ok, err := server.poke(tok.ID); err != nil || ok {
+		t.Errorf("token not deleted: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(server.storage, id)); !os.IsNotExist(err) {
+		t.Errorf("storage not deleted: %v", err)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	for _, keys := range [][]string{nil, {"a"}} {
+		server, testSrv, cookie, close := newTestServer(t)
+		server.dedup = true
+		server.compress = encGzip
+		if keys != nil {
+			server.keys = testKeyring(t, keys...)
+		}
+
+		logs := bytes.Repeat([]byte("2024-01-01 12:00:00 INFO request served\n"), 16*1024)
+		sum := fmt.Sprintf("%x", sha256.Sum256(logs))
+
+		var ids []string
+		for i := 0; i < 2; i++ {
+			tok, err := server.generate()
+			if err != nil {
+				t.Fatalf("generate: %v", err)
+			}
+
+			id := hex.EncodeToString(tok.ID)
+			ids = append(ids, id)
+			if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "server.log", id, "", logs, nil); err != nil {
+				t.Fatalf("transfer: %v", err)
+			}
+
+			// a resumed upload of the same content is the same blob
+			if err := tokenshare.Resume(testSrv.URL+tokenshare.ReqResumable, "copy.log", id, "", bytes.NewReader(logs), int64(len(logs)), nil); err != nil {
+				t.Fatalf("resume: %v", err)
+			}
+		}
+
+		blobs, err := ioutil.ReadDir(filepath.Join(server.storage, blobDir))
+		if err != nil || len(blobs) != 1 || blobs[0].Name() != sum {
+			t.Fatalf("unexpected blobs: %v, %v", blobs, err)
+		}
+
+		raw, err := ioutil.ReadFile(filepath.Join(server.storage, blobDir, sum))
+		if err != nil || len(raw) >= len(logs) {
+			t.Errorf("blob not compressed: %d bytes, %v", len(raw), err)
+		}
+
+		if b, ok, err := server.blob(sum); err != nil || !ok || b.Refs != 4 || (len(b.DataKey) > 0) != (keys != nil) {
+			t.Errorf("unexpected blob: %+v, %v, %v", b, ok, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(server.storage, ids[0], "server.log")); !os.IsNotExist(err) {
+			t.Errorf("file stored with token: %v", err)
+		}
+
+		if keys != nil {
+			server.keys = testKeyring(t, "b", "a")
+			if n, err := server.rewrap(); err != nil || n != 3 {
+				t.Errorf("rewrap: %d, %v", n, err)
+			}
+			server.keys = testKeyring(t, "b")
+		}
+
+		// the blob is kept until its last token is gone
+		if err := tokenshare.Delete(testSrv.URL+tokenshare.ReqDelete, cookie, ids[0]); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+
+		for _, name := range []string{"server.log", "copy.log"} {
+			res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, ids[1], name, "")
+			if err != nil || !bytes.Equal(res, logs) {
+				t.Errorf("download %s differs: %v", name, err)
+			}
+		}
+
+		if b, _, err := server.blob(sum); err != nil || b.Refs != 2 {
+			t.Errorf("refs %d, want 2: %v", b.Refs, err)
+		}
+
+		if err := tokenshare.Delete(testSrv.URL+tokenshare.ReqDelete, cookie, ids[1]); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+
+		if _, ok, err := server.blob(sum); err != nil || ok {
+			t.Errorf("blob record kept: %v", err)
+		}
+
+		if _, err := os.Stat(filepath.Join(server.storage, blobDir, sum)); !os.IsNotExist(err) {
+			t.Errorf("blob kept: %v", err)
+		}
+
+		close()
+	}
+}
+
+func TestQuota(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+	server.quota = 100 * 1024
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if tok.Owner != "user" {
+		t.Errorf("owner %q", tok.Owner)
+	}
+
+	// the owner is kept from recipients
+	single, err := tokenshare.Call(testSrv.URL+tokenshare.ReqSingle, nil, map[string]string{tokenshare.ID: tok.Key()})
+	if err != nil {
+		t.Fatalf("single: %v", err)
+	}
+
+	if res, err := tokenshare.Unmarshal(single); err != nil || res.Owner != "" {
+		t.Errorf("owner leaked: %q, %v", res.Owner, err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := make([]byte, 60*1024)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	// uploads are refused by their declared size, before they are read
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "bar", id, "", buf, nil); err == nil || !strings.Contains(err.Error(), tokenshare.QuotaExceeded{}.Error()) {
+		t.Errorf("transfer beyond quota: %v", err)
+	}
+
+	if err := tokenshare.Resume(testSrv.URL+tokenshare.ReqResumable, "bar", id, "", bytes.NewReader(buf), int64(len(buf)), nil); err == nil {
+		t.Errorf("resumable upload beyond quota succeeded")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, testSrv.URL+tokenshare.ReqPut+id+"/bar", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("put beyond quota: %s", resp.Status)
+	}
+
+	// a chunked upload declares no size, it is cut off while it streams
+	req, err = http.NewRequest(http.MethodPut, testSrv.URL+tokenshare.ReqPut+id+"/bar", io.MultiReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInsufficientStorage {
+		t.Errorf("chunked put beyond quota: %s", resp.Status)
+	}
+
+	// the quota is checked again when the file is recorded, another
+	// upload may have claimed the space while it streamed
+	tmp, n, err := server.write(id, bytes.NewReader(buf), -1, "", nil)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	uploading := func(t *tokenshare.Token) { t.Status = tokenshare.StatusUploading }
+	if _, err := server.record(tok.ID, tmp, tokenshare.FileInfo{Name: "late", Size: n}, nil, uploading); !errors.Is(err, tokenshare.QuotaExceeded{}) {
+		t.Errorf("record beyond quota: %v", err)
+	}
+	_ = server.files.remove(tmp)
+
+	if _, err := tokenshare.GetUsage(testSrv.URL+tokenshare.ReqUsage, nil); err == nil {
+		t.Errorf("unauthorized usage succeeded")
+	}
+
+	u, err := tokenshare.GetUsage(testSrv.URL+tokenshare.ReqUsage, cookie)
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+
+	if u.Used != int64(len(buf)) || u.Quota != server.quota || u.Admin != "user" || u.AdminUsed != u.Used || u.Free == 0 {
+		t.Errorf("unexpected usage: %+v", u)
+	}
+
+	// the quota of the admin applies on top of the global one
+	server.adminQuota = 80 * 1024
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "baz", id, "", buf[:30*1024], nil); err == nil {
+		t.Errorf("transfer beyond admin quota succeeded")
+	}
+	server.adminQuota = 0
+
+	// a revoked token holds nothing anymore
+	if err := tokenshare.Revoke(testSrv.URL+tokenshare.ReqRevoke, cookie, id); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+
+	other, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "bar", hex.EncodeToString(other.ID), "", buf, nil); err != nil {
+		t.Errorf("transfer after revoke: %v", err)
+	}
+
+	// the files of the other tokens count when a file is recorded
+	third, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	tmp, n, err = server.write(hex.EncodeToString(third.ID), bytes.NewReader(buf), -1, "", nil)
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if _, err := server.record(third.ID, tmp, tokenshare.FileInfo{Name: "late", Size: n}, nil, uploading); !errors.Is(err, tokenshare.QuotaExceeded{}) {
+		t.Errorf("record beyond quota of all tokens: %v", err)
+	}
+	_ = server.files.remove(tmp)
+}
+
+func TestMetadata(t *testing.T) {
+	_, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	opts := tokenshare.CreateOptions{Label: "invoices", Recipient: "ACME Corp.", Note: "Q3 & Q4"}
+	if _, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, opts); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	toks, err := tokenshare.List(testSrv.URL+tokenshare.ReqList, cookie)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(toks) != 1 {
+		t.Fatalf("unexpected list: %v", toks)
+	}
+
+	tok := toks[0]
+	if tok.Label != opts.Label || tok.Recipient != opts.Recipient || tok.Note != opts.Note {
+		t.Errorf("%v != %v", tok, opts)
+	}
+
+	// the recipient sees the note only if it is meant for them
+	single := func(id string) tokenshare.Token {
+		buf, err := tokenshare.Call(testSrv.URL+tokenshare.ReqSingle, nil, map[string]string{tokenshare.ID: id})
+		if err != nil {
+			t.Fatalf("single: %v", err)
+		}
+
+		res, err := tokenshare.Unmarshal(buf)
+		if err != nil {
+			t.Fatalf("unmarshal: %v", err)
+		}
+
+		return res
+	}
+
+	if res := single(tok.Key()); res.Label != "" || res.Recipient != "" || res.Note != "" {
+		t.Errorf("metadata leaked: %v", res)
+	}
+
+	opts.ShowNote = true
+	shown, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, opts)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if res := single(shown.Key()); res.Label != "" || res.Recipient != "" || res.Note != opts.Note {
+		t.Errorf("unexpected token: %v", res)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxDownloads: 3})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", []byte("FOO"), nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	succeeded := 0
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", ""); err == nil {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if succeeded != tok.MaxDownloads {
+		t.Errorf("%d downloads succeeded, want %d", succeeded, tok.MaxDownloads)
+	}
+
+	res, ok, err := server.poke(tok.ID)
+	if err != nil || !ok {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if res.Downloads != tok.MaxDownloads {
+		t.Errorf("%d downloads counted, want %d", res.Downloads, tok.MaxDownloads)
+	}
+
+	if _, err := os.Stat(filepath.Join(server.storage, id)); !os.IsNotExist(err) {
+		t.Errorf("storage not purged: %v", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxSize: 1024 * 1024})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "small", id, "", make([]byte, 1024*1024), nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "large", id, "", make([]byte, 1024*1024+1), nil); err == nil {
+		t.Errorf("transfer beyond size limit succeeded")
+	}
+
+	body := bytes.NewBuffer(make([]byte, 10*1024*1024))
+	resp, err := http.Post(testSrv.URL+tokenshare.ReqTransfer+"?"+tokenshare.ID+"="+id, "multipart/form-data; boundary=foo", body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	if _, err := os.Stat(filepath.Join(server.storage, id, "large")); !os.IsNotExist(err) {
+		t.Errorf("oversized upload stored: %v", err)
+	}
+}
+
+func TestStreamedUpload(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	// a single upload larger than the multipart memory limit
+	server.maxMemory = 1024
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+
+	// fields before the file part are skipped
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	_ = mw.WriteField("comment", "hello")
+	fw, err := mw.CreateFormFile(tokenshare.File, "foo")
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	_, _ = fw.Write(buf)
+	_ = mw.Close()
+
+	resp, err := http.Post(testSrv.URL+tokenshare.ReqTransfer+"?"+tokenshare.ID+"="+id, mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if f, ok := stored.File("foo"); !ok || f.Size != int64(len(buf)) {
+		t.Errorf("unexpected files: %v", stored.Files)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(server.storage, id))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("unexpected storage: %v, %v", entries, err)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("streamed upload differs")
+	}
+}
+
+func TestReplace(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxBytes: 8})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	transfer := func(buf []byte) error {
+		return tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil)
+	}
+
+	if err := transfer([]byte("FOOFOO")); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	// a smaller file replaces the previous one completely
+	if err := transfer([]byte("BAR")); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	// a failed upload leaves the stored file untouched
+	if err := transfer([]byte("BAZBAZBAZ")); err == nil {
+		t.Errorf("transfer beyond byte limit succeeded")
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if string(res) != "BAR" {
+		t.Errorf("%s != BAR", string(res))
+	}
+
+	// temporary files left by a crash are removed on startup
+	dir := filepath.Join(server.storage, id)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".upload-123"), []byte("BA"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if err := server.scrub(); err != nil {
+		t.Fatalf("scrub: %v", err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 || entries[0].Name() != "foo" {
+		t.Errorf("unexpected storage: %v, %v", entries, err)
+	}
+}
+
+func TestUploadLock(t *testing.T) {
+	server, testSrv, _, close := newTestServer(t)
+	defer close()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	transfer := func(name string) error {
+		return tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, name, id, "", []byte("FOO"), nil)
+	}
+
+	// an upload in progress holds the lock of the token
+	if !server.uploads.acquire(context.Background(), id, 0) {
+		t.Fatalf("acquire failed")
+	}
+
+	resp, err := http.Post(testSrv.URL+tokenshare.ReqTransfer+"?"+tokenshare.ID+"="+id, "multipart/form-data; boundary=foo", nil)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusConflict)
+	}
+
+	// other tokens are not affected
+	other, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", hex.EncodeToString(other.ID), "", []byte("FOO"), nil); err != nil {
+		t.Errorf("transfer to other token: %v", err)
+	}
+
+	// with a queue the upload waits for the lock
+	server.queue = 5 * time.Second
+
+	done := make(chan error)
+	go func() {
+		done <- transfer("foo")
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("queued upload did not wait: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	server.uploads.release(id)
+	if err := <-done; err != nil {
+		t.Errorf("queued transfer: %v", err)
+	}
+
+	// the queue is bounded
+	server.queue = 50 * time.Millisecond
+	if !server.uploads.acquire(context.Background(), id, 0) {
+		t.Fatalf("acquire failed")
+	}
+	defer server.uploads.release(id)
+
+	if err := transfer("bar"); err == nil {
+		t.Errorf("transfer succeeded while locked")
+	}
+}
+
+func TestPut(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxSize: 8, Passphrase: "secret"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	call := testSrv.URL + tokenshare.ReqPut
+	buf := []byte("REPORT")
+
+	if err := tokenshare.Put(call, tok.Key(), "report.pdf", "", buf, nil); err == nil {
+		t.Errorf("put without passphrase succeeded")
+	}
+
+	if err := tokenshare.Put(call, tok.Key(), "big.pdf", "secret", []byte("TOO LARGE"), nil); err == nil {
+		t.Errorf("put beyond size limit succeeded")
+	}
+
+	if err := tokenshare.Put(call, tok.Key(), "report.pdf", "secret", buf, nil); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+
+	resp, err := http.Post(call+tok.Key()+"/report.pdf", "application/pdf", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	sum := sha256.Sum256(buf)
+	if f, ok := stored.File("report.pdf"); !ok || len(stored.Files) != 1 || f.Size != int64(len(buf)) || f.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("unexpected files: %v", stored.Files)
+	}
+
+	if stored.State() != tokenshare.StatusComplete {
+		t.Errorf("state %s, want %s", stored.State(), tokenshare.StatusComplete)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, tok.Key(), "report.pdf", "secret")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("%s != %s", string(res), string(buf))
+	}
+}
+
+func TestShare(t *testing.T) {
+	_, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	buf := []byte("GREETING")
+	if _, err := tokenshare.Share(testSrv.URL+tokenshare.ReqShare, nil, "foo", buf, tokenshare.CreateOptions{}, nil); err == nil {
+		t.Errorf("unauthorized share succeeded")
+	}
+
+	tok, err := tokenshare.Share(testSrv.URL+tokenshare.ReqShare, cookie, "foo", buf, tokenshare.CreateOptions{Label: "bar"}, nil)
+	if err != nil {
+		t.Fatalf("share: %v", err)
+	}
+
+	if tok.Kind != tokenshare.KindShare || tok.Label != "bar" || len(tok.Files) != 1 {
+		t.Fatalf("unexpected token: %v", tok)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("%s != %s", string(res), string(buf))
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "bar", id, "", buf, nil); err == nil {
+		t.Errorf("transfer to share token succeeded")
+	}
+}
+
+func TestWordCodes(t *testing.T) {
+	server, testSrv, _, close := newTestServer(t)
+	defer close()
+
+	legacy, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	server.ids = wordIDs{5}
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	buf := []byte("GREETING")
+	for _, code := range []string{tok.Code, hex.EncodeToString(legacy.ID)} {
+		if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", code, "", buf, nil); err != nil {
+			t.Fatalf("transfer: %v", err)
+		}
+
+		res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, code, "foo", "")
+		if err != nil {
+			t.Fatalf("download: %v", err)
+		}
+
+		if !bytes.Equal(res, buf) {
+			t.Errorf("%s != %s", string(res), string(buf))
+		}
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	_, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{Passphrase: "secret", Note: "private"})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if !tok.Protected || tok.Hash != nil {
+		t.Fatalf("unexpected token: %v", tok)
+	}
+
+	id := tok.Key()
+	buf := []byte("GREETING")
+
+	for _, passphrase := range []string{"", "wrong"} {
+		if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, passphrase, buf, nil); err == nil {
+			t.Errorf("transfer with passphrase %q succeeded", passphrase)
+		}
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "secret", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	for _, passphrase := range []string{"", "wrong"} {
+		if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", passphrase); err == nil {
+			t.Errorf("download with passphrase %q succeeded", passphrase)
+		}
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "secret")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("%s != %s", string(res), string(buf))
+	}
+
+	// a passphrase in the query would end up in logs, it is ignored
+	resp, err := http.Get(testSrv.URL + tokenshare.ReqDownload + "?" + url.Values{tokenshare.ID: {id}, tokenshare.Name: {"foo"}, "passphrase": {"secret"}}.Encode())
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("passphrase in the query: got %s", resp.Status)
+	}
+
+	single, err := tokenshare.Call(testSrv.URL+tokenshare.ReqSingle, nil, map[string]string{tokenshare.ID: id})
+	if err != nil {
+		t.Fatalf("single: %v", err)
+	}
+
+	summary, err := tokenshare.Unmarshal(single)
+	if err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	if !summary.Protected || summary.Note != "" || len(summary.Files) != 0 || summary.Hash != nil {
+		t.Errorf("protected token leaked: %v", summary)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	state := func(tok tokenshare.Token) tokenshare.Status {
+		res, ok, err := server.poke(tok.ID)
+		if err != nil || !ok {
+			t.Fatalf("poke: %v", err)
+		}
+
+		return res.State()
+	}
+
+	tok, err := tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if s := state(tok); s != tokenshare.StatusCreated {
+		t.Errorf("%s != %s", s, tokenshare.StatusCreated)
+	}
+
+	id := tok.Key()
+	buf := []byte("GREETING")
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	if s := state(tok); s != tokenshare.StatusComplete {
+		t.Errorf("%s != %s", s, tokenshare.StatusComplete)
+	}
+
+	if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "", ""); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if s := state(tok); s != tokenshare.StatusDownloaded {
+		t.Errorf("%s != %s", s, tokenshare.StatusDownloaded)
+	}
+
+	// downloads are left, the recipient may send more
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "bar", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer to downloaded token: %v", err)
+	}
+
+	if s := state(tok); s != tokenshare.StatusComplete {
+		t.Errorf("%s != %s", s, tokenshare.StatusComplete)
+	}
+
+	if err := tokenshare.Revoke(testSrv.URL+tokenshare.ReqRevoke, cookie, id); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+
+	if s := state(tok); s != tokenshare.StatusRevoked {
+		t.Errorf("%s != %s", s, tokenshare.StatusRevoked)
+	}
+
+	if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "", ""); err == nil {
+		t.Errorf("download of revoked token succeeded")
+	}
+
+	if err := tokenshare.Revoke(testSrv.URL+tokenshare.ReqRevoke, cookie, id); err == nil {
+		t.Errorf("second revoke succeeded")
+	}
+
+	// the last download ends the token
+	tok, err = tokenshare.Create(testSrv.URL+tokenshare.ReqCreate, cookie, tokenshare.CreateOptions{MaxDownloads: 2})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	id = tok.Key()
+	for i := 0; i < 2; i++ {
+		if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, fmt.Sprintf("foo%d", i), id, "", buf, nil); err != nil {
+			t.Fatalf("transfer %d: %v", i, err)
+		}
+
+		if _, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, fmt.Sprintf("foo%d", i), ""); err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+	}
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "bar", id, "", buf, nil); err == nil {
+		t.Errorf("transfer to exhausted token succeeded")
+	}
+}
+
+func TestResumable(t *testing.T) {
+	server, testSrv, _, clear := newTestServer(t)
+	defer clear()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	call := testSrv.URL + tokenshare.ReqResumable
+
+	buf := make([]byte, tokenshare.ChunkSize*2+100)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+
+	// start an upload and send only a part of the first chunk
+	req, err := http.NewRequest(http.MethodPost, call+id, nil)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	sum := sha256.Sum256(buf)
+	req.Header.Set("Upload-Length", fmt.Sprint(len(buf)))
+	req.Header.Set("Upload-Metadata", tokenshare.UploadMetadata("foo", hex.EncodeToString(sum[:]), nil))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: %s", resp.Status)
+	}
+
+	patch := func(offset, n int) int {
+		req, err := http.NewRequest(http.MethodPatch, testSrv.URL+resp.Header.Get("Location"), bytes.NewReader(buf[offset:offset+n]))
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", fmt.Sprint(offset))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("patch: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	if code := patch(0, 1000); code != http.StatusNoContent {
+		t.Fatalf("patch: %d", code)
+	}
+
+	if code := patch(0, 1000); code != http.StatusConflict {
+		t.Errorf("patch at stale offset: %d", code)
+	}
+
+	progress := make(chan int)
+	sent := 0
+	done := make(chan struct{})
+	go func() {
+		for n := range progress {
+			sent += n
+		}
+		close(done)
+	}()
+
+	// resuming continues at the acknowledged offset
+	if err := tokenshare.Resume(call, "foo", id, "", bytes.NewReader(buf), int64(len(buf)), progress); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	close(progress)
+	<-done
+
+	if sent != len(buf) {
+		t.Errorf("progress %d != %d", sent, len(buf))
+	}
+
+	stored, ok, err := server.poke(tok.ID)
+	if err != nil || !ok {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if len(stored.Uploads) != 0 || stored.State() != tokenshare.StatusComplete {
+		t.Errorf("unexpected token: %v", stored)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("resumed upload differs")
+	}
+}
+
+func TestResumableComplete(t *testing.T) {
+	server, testSrv, _, clear := newTestServer(t)
+	defer clear()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	call := testSrv.URL + tokenshare.ReqResumable
+
+	files := func() []tokenshare.FileInfo {
+		stored, ok, err := server.poke(tok.ID)
+		if err != nil || !ok {
+			t.Fatalf("poke: %v", err)
+		}
+
+		if len(stored.Uploads) != 0 {
+			t.Errorf("pending uploads: %v", stored.Uploads)
+		}
+
+		return stored.Files
+	}
+
+	// an empty file is complete without any PATCH
+	if err := tokenshare.Resume(call, "empty", id, "", bytes.NewReader(nil), 0, nil); err != nil {
+		t.Fatalf("resume empty: %v", err)
+	}
+
+	if f := files(); len(f) != 1 || f[0].Name != "empty" || f[0].Size != 0 {
+		t.Errorf("unexpected files: %v", f)
+	}
+
+	// a PATCH beyond the length completes the upload with its bytes
+	buf := []byte("GREETING")
+	req, err := http.NewRequest(http.MethodPost, call+id, nil)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", fmt.Sprint(len(buf)))
+	req.Header.Set("Upload-Metadata", tokenshare.UploadMetadata("long", "", nil))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	req, err = http.NewRequest(http.MethodPatch, testSrv.URL+resp.Header.Get("Location"), bytes.NewReader(append(buf, "MORE"...)))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("patch: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if f := files(); len(f) != 2 || f[1].Name != "long" || f[1].Size != int64(len(buf)) {
+		t.Errorf("unexpected files: %v", f)
+	}
+
+	// the client finds an upload under the name the server stored it
+	if err := tokenshare.Resume(call, "dir/foo ", id, "", bytes.NewReader(buf), int64(len(buf)), nil); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+
+	if f := files(); len(f) != 3 || f[2].Name != "foo" {
+		t.Errorf("unexpected files: %v", f)
+	}
+}
+
+func TestResumeStale(t *testing.T) {
+	server, testSrv, _, clear := newTestServer(t)
+	defer clear()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	call := testSrv.URL + tokenshare.ReqResumable
+
+	old := bytes.Repeat([]byte("A"), 2000)
+	buf := bytes.Repeat([]byte("B"), 2000)
+
+	// an upload of other content under the same name was cut off
+	start := func(data []byte) {
+		sum := sha256.Sum256(data)
+		req, err := http.NewRequest(http.MethodPost, call+id, nil)
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Length", fmt.Sprint(len(data)))
+		req.Header.Set("Upload-Metadata", tokenshare.UploadMetadata("foo", hex.EncodeToString(sum[:]), nil))
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("create: %s", resp.Status)
+		}
+
+		req, err = http.NewRequest(http.MethodPatch, testSrv.URL+resp.Header.Get("Location"), bytes.NewReader(data[:1000]))
+		if err != nil {
+			t.Fatalf("request: %v", err)
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("patch: %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("patch: %s", resp.Status)
+		}
+
+	}
+	start(old)
+
+	// the new upload starts over instead of appending to the old bytes
+	if err := tokenshare.Resume(call, "foo", id, "", bytes.NewReader(buf), int64(len(buf)), nil); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+
+	res, err := tokenshare.Download(testSrv.URL+tokenshare.ReqDownload, id, "foo", "")
+	if err != nil {
+		t.Fatalf("download: %v", err)
+	}
+
+	if !bytes.Equal(res, buf) {
+		t.Errorf("stale upload was resumed")
+	}
+
+	// an abandoned upload is dropped after the upload TTL
+	if tok, err = server.generate(); err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	id = hex.EncodeToString(tok.ID)
+	start(old)
+	server.uploadTTL = time.Hour
+
+	uploads := func() int {
+		stored, ok, err := server.poke(tok.ID)
+		if err != nil || !ok {
+			t.Fatalf("poke: %v", err)
+		}
+
+		return len(stored.Uploads)
+	}
+
+	if err := server.sweep(time.Now()); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	if n := uploads(); n != 1 {
+		t.Fatalf("%d uploads after sweep, want 1", n)
+	}
+
+	if err := server.sweep(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+
+	if n := uploads(); n != 0 {
+		t.Errorf("%d uploads after the upload TTL, want 0", n)
+	}
+
+	keys, err := server.files.list(partialDir(id, "foo"))
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(keys) != 0 {
+		t.Errorf("chunks left: %v", keys)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	server, testSrv, cookie, close := newTestServer(t)
+	defer close()
+
+	tok, err := server.generate()
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+
+	id := hex.EncodeToString(tok.ID)
+	buf := []byte("FOO")
+	sum := sha256.Sum256(buf)
+	want := hex.EncodeToString(sum[:])
+
+	if err := tokenshare.Transfer(testSrv.URL+tokenshare.ReqTransfer, "foo", id, "", buf, nil); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+
+	toks, err := tokenshare.List(testSrv.URL+tokenshare.ReqList, cookie)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+
+	if len(toks) != 1 || len(toks[0].Files) != 1 || toks[0].Files[0].SHA256 != want {
+		t.Fatalf("unexpected list: %v", toks)
+	}
+
+	// a multipart upload with a digest that does not match
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile(tokenshare.File, "bar")
+	_, _ = fw.Write([]byte("BAR"))
+	_ = mw.Close()
+
+	query := url.Values{tokenshare.ID: {id}, tokenshare.SHA256: {want}}
+	resp, err := http.Post(testSrv.URL+tokenshare.ReqTransfer+"?"+query.Encode(), mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	// a resumable upload announcing the wrong digest
+	req, err := http.NewRequest(http.MethodPost, testSrv.URL+tokenshare.ReqResumable+id, nil)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", "3")
+	req.Header.Set("Upload-Metadata", "filename YmF6,sha256 "+base64.StdEncoding.EncodeToString([]byte(want)))
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	req, err = http.NewRequest(http.MethodPatch, testSrv.URL+resp.Header.Get("Location"), bytes.NewReader([]byte("BAZ")))
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("patch: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusUnprocessableEntity)
+	}
+
+	stored, _, err := server.poke(tok.ID)
+	if err != nil {
+		t.Fatalf("poke: %v", err)
+	}
+
+	if len(stored.Files) != 1 || len(stored.Uploads) != 0 || stored.State() != tokenshare.StatusComplete {
+		t.Errorf("unexpected token: %v", stored)
+	}
+
+	single, err := tokenshare.Call(testSrv.URL+tokenshare.ReqSingle, nil, map[string]string{tokenshare.ID: id})
+	if err != nil {
+		t.Fatalf("single: %v", err)
+	}
+
+	if !bytes.Contains(single, []byte(want)) {
+		t.Errorf("single lacks digest: %s", single)
+	}
+}
+
 func TestTransferBrowser(t *testing.T) {
 	once := sync.Once{}
 	wg := sync.WaitGroup{}
@@ -247,7 +2485,6 @@ func newTestServer(t *testing.T) (*server, *httptest.Server, *http.Cookie, func(
 		www,
 		"user",
 		"pass",
-		16,
 		int64(1024*1024*1024),
 	)
 	if err != nil {
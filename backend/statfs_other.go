@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package main
+
+// diskFree reports the free space of dir as unknown where it cannot be
+// queried.
+func diskFree(dir string) (int64, error) {
+	return -1, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+// transitions lists the states a token may move to from each state.
+// Expired and revoked tokens are final.
+var transitions = map[tokenshare.Status][]tokenshare.Status{
+	tokenshare.StatusCreated: {
+		tokenshare.StatusUploading,
+		tokenshare.StatusExpired,
+		tokenshare.StatusRevoked,
+	},
+	// an upload that was cut off leaves the token uploading, so another
+	// upload may start from there
+	tokenshare.StatusUploading: {
+		tokenshare.StatusUploading,
+		tokenshare.StatusCreated,
+		tokenshare.StatusComplete,
+		tokenshare.StatusExpired,
+		tokenshare.StatusRevoked,
+	},
+	tokenshare.StatusComplete: {
+		tokenshare.StatusUploading,
+		tokenshare.StatusDownloaded,
+		tokenshare.StatusExpired,
+		tokenshare.StatusRevoked,
+	},
+	// a request token that was downloaded may receive more files, as long
+	// as downloads are left
+	tokenshare.StatusDownloaded: {
+		tokenshare.StatusUploading,
+		tokenshare.StatusDownloaded,
+		tokenshare.StatusExpired,
+		tokenshare.StatusRevoked,
+	},
+}
+
+type transitionError struct {
+	from, to tokenshare.Status
+}
+
+func (e transitionError) Error() string {
+	return fmt.Sprintf("token is %s, cannot become %s", e.from, e.to)
+}
+
+// transition moves tok to the state to, if the state machine permits it.
+func transition(tok *tokenshare.Token, to tokenshare.Status) error {
+	from := tok.State()
+	if from == tokenshare.StatusDownloaded && to == tokenshare.StatusUploading && (tok.Kind != tokenshare.KindRequest || tok.Exhausted()) {
+		return transitionError{from, to}
+	}
+
+	for _, s := range transitions[from] {
+		if s == to {
+			tok.Status = to
+			return nil
+		}
+	}
+
+	return transitionError{from, to}
+}
+
+// finish completes a token after an upload, unless resumable uploads to it
+// are still pending.
+func finish(tok *tokenshare.Token) error {
+	if len(tok.Uploads) > 0 {
+		return transition(tok, tokenshare.StatusUploading)
+	}
+
+	return transition(tok, tokenshare.StatusComplete)
+}
+
+// settle moves a token whose upload failed back to the state it had before.
+func settle(tok *tokenshare.Token) error {
+	if tok.State() != tokenshare.StatusUploading || len(tok.Uploads) > 0 {
+		return nil
+	}
+
+	if len(tok.Files) == 0 {
+		return transition(tok, tokenshare.StatusCreated)
+	}
+
+	return transition(tok, tokenshare.StatusComplete)
+}
+
+// code returns the HTTP status code that reports err.
+func code(err error) int {
+	switch err.(type) {
+	case tokenshare.TokenFull:
+		return http.StatusForbidden
+	case tokenshare.DownloadLimit:
+		return http.StatusGone
+	case tokenshare.ChecksumMismatch:
+		return http.StatusUnprocessableEntity
+	case tokenshare.QuotaExceeded:
+		return http.StatusInsufficientStorage
+	case transitionError:
+		return http.StatusConflict
+	}
+
+	return http.StatusInternalServerError
+}
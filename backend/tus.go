@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jostillmanns/tokenshare"
+)
+
+// The resumable endpoint implements the core protocol and the creation
+// extension of tus 1.0, see https://tus.io/protocols/resumable-upload.
+//
+//	POST  /resumable/<id>         creates an upload, Location names it
+//	HEAD  /resumable/<id>/<name>  reports the acknowledged offset
+//	PATCH /resumable/<id>/<name>  appends to the upload at that offset
+//
+// The offset of every upload is kept in the token record and the bytes
+// below the partial directory, one object per PATCH request keyed by its
+// offset, so an upload survives dropped connections and server restarts.
+const (
+	tusVersion     = "1.0.0"
+	tusContentType = "application/offset+octet-stream"
+
+	partial = ".partial"
+)
+
+// partialDir is where the bytes of a resumable upload are kept until it
+// completes. It lies outside the token directory, so that a partial upload
+// is never served and cannot collide with a file of the token.
+func partialDir(id, name string) string {
+	return path.Join(partial, id, name)
+}
+
+// chunkKey is the key of the bytes of an upload received at offset. The
+// offset is zero padded, so that the chunks list in upload order.
+func chunkKey(id, name string, offset int64) string {
+	return path.Join(partialDir(id, name), fmt.Sprintf("%020d", offset))
+}
+
+// partialKey returns the key the chunks of upload p are encrypted with,
+// nil if they are stored plainly.
+func (s *server) partialKey(bid []byte, p tokenshare.Partial) ([]byte, error) {
+	if !p.Encrypted {
+		return nil, nil
+	}
+
+	key, err := s.dataKey(bid)
+	if err == nil && key == nil {
+		err = errors.New("upload is encrypted, but no master keys are configured")
+	}
+
+	return key, err
+}
+
+// chunks reads the chunks of an upload in order, as one stream.
+type chunks struct {
+	open   func(key string) (object, error)
+	keys   []string
+	cur    object
+	offset int64
+}
+
+func (c *chunks) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+
+			key := c.keys[0]
+			if at, err := strconv.ParseInt(path.Base(key), 10, 64); err != nil || at != c.offset {
+				return 0, fmt.Errorf("upload is missing bytes at %d", c.offset)
+			}
+
+			f, err := c.open(key)
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.keys = f, c.keys[1:]
+		}
+
+		n, err := c.cur.Read(p)
+		c.offset += int64(n)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (c *chunks) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+
+	return c.cur.Close()
+}
+
+func (s *server) resumable(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if req.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	rest := strings.TrimPrefix(req.URL.Path, tokenshare.ReqResumable)
+	parts := strings.SplitN(rest, "/", 2)
+
+	token, bid, ok := s.lookup(w, parts[0])
+	if !ok {
+		return
+	}
+
+	if !s.authorize(w, req, token) {
+		return
+	}
+
+	if token.Kind == tokenshare.KindShare {
+		http.Error(w, "token does not accept uploads", http.StatusForbidden)
+		return
+	}
+
+	if req.Method != http.MethodHead {
+		var release func()
+		token, release, ok = s.exclusive(w, req, bid)
+		if !ok {
+			return
+		}
+		defer release()
+	}
+
+	if len(parts) == 1 {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		s.createUpload(w, req, bid, token)
+		return
+	}
+
+	name, ok := uploadName(w, parts[1])
+	if !ok {
+		return
+	}
+
+	switch req.Method {
+	case http.MethodHead:
+		s.headUpload(w, name, token)
+	case http.MethodPatch:
+		s.patchUpload(w, req, bid, name, token)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadName checks the file name of an upload. It reports false after
+// writing an error response.
+func uploadName(w http.ResponseWriter, name string) (string, bool) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		http.Error(w, fmt.Sprintf("invalid file name: %q", name), http.StatusBadRequest)
+		return "", false
+	}
+
+	return name, true
+}
+
+func (s *server) createUpload(w http.ResponseWriter, req *http.Request, bid []byte, token tokenshare.Token) {
+	if token.Exhausted() {
+		http.Error(w, tokenshare.DownloadLimit{}.Error(), http.StatusGone)
+		return
+	}
+
+	size, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	if token.MaxSize > 0 && size > token.MaxSize {
+		http.Error(w, fmt.Sprintf("upload exceeds %d bytes", token.MaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta, err := tokenshare.ParseUploadMetadata(req.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := sanitize(meta["filename"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name = unique(token, name)
+
+	e2e, err := tokenshare.ParseE2E(meta[tokenshare.Encryption])
+	if err == nil && e2e != nil {
+		err = e2e.Check(size)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := token.Add(tokenshare.FileInfo{Name: name, Size: size}); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	if !s.admit(w, token, size) {
+		return
+	}
+
+	// chunks of an earlier upload of the same name would be read as part
+	// of this one
+	if err := s.files.removeAll(partialDir(hex.EncodeToString(bid), name)); err != nil {
+		http.Error(w, fmt.Sprintf("remove: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	p := tokenshare.Partial{Name: name, Size: size, SHA256: strings.ToLower(meta[tokenshare.SHA256]), Encrypted: s.keys != nil, E2E: e2e, T: time.Now()}
+	if _, err := s.modify(bid, func(t *tokenshare.Token) error {
+		if err := transition(t, tokenshare.StatusUploading); err != nil {
+			return err
+		}
+
+		t.SetPartial(p)
+		return nil
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("unable to start upload: %v", err), code(err))
+		return
+	}
+
+	// an empty file receives no PATCH, it is complete right away
+	if size == 0 {
+		if err := s.completeUpload(bid, p); err != nil {
+			http.Error(w, fmt.Sprintf("unable to complete upload: %v", err), code(err))
+			return
+		}
+	}
+
+	u := url.URL{Path: tokenshare.ReqResumable + url.PathEscape(token.Key()) + "/" + url.PathEscape(name)}
+	w.Header().Set("Location", u.EscapedPath())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *server) headUpload(w http.ResponseWriter, name string, token tokenshare.Token) {
+	p, ok := token.Partial(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such upload: %s", name), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(p.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(p.Size, 10))
+	w.Header().Set("Upload-Metadata", tokenshare.UploadMetadata(p.Name, p.SHA256, p.E2E))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *server) patchUpload(w http.ResponseWriter, req *http.Request, bid []byte, name string, token tokenshare.Token) {
+	if req.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	p, ok := token.Partial(name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no such upload: %s", name), http.StatusNotFound)
+		return
+	}
+
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset != p.Offset {
+		http.Error(w, fmt.Sprintf("offset mismatch, upload is at %d", p.Offset), http.StatusConflict)
+		return
+	}
+
+	dataKey, err := s.partialKey(bid, p)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("data key: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// a chunk that was cut off before its offset was recorded is replaced
+	f, err := s.createFile(chunkKey(hex.EncodeToString(bid), name, offset), dataKey)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("create: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// whatever arrives is kept, even if the connection drops, so that the
+	// client can resume from there
+	n, copyErr := io.Copy(f, http.MaxBytesReader(w, req.Body, p.Size-offset))
+	if n == 0 {
+		f.abort()
+	} else if err := f.commit(); err != nil {
+		http.Error(w, fmt.Sprintf("commit: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	token, err = s.modify(bid, func(t *tokenshare.Token) error {
+		q, ok := t.Partial(name)
+		if !ok || q.Offset != offset {
+			return fmt.Errorf("upload %s changed concurrently", name)
+		}
+
+		q.Offset += n
+		q.T = time.Now()
+		t.SetPartial(q)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to record offset: %v", err), code(err))
+		return
+	}
+	offset += n
+
+	// once all bytes are stored the upload is complete, even if the
+	// request carried more or broke off afterwards
+	if offset == p.Size {
+		if err := s.completeUpload(bid, p); err != nil {
+			http.Error(w, fmt.Sprintf("unable to complete upload: %v", err), code(err))
+			return
+		}
+	} else if copyErr != nil {
+		http.Error(w, fmt.Sprintf("copy: %v", copyErr), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// completeUpload verifies a finished upload, moves it into the token
+// directory and records it as file of the token.
+func (s *server) completeUpload(bid []byte, p tokenshare.Partial) error {
+	id := hex.EncodeToString(bid)
+	name := p.Name
+
+	keys, err := s.files.list(partialDir(id, name))
+	if err != nil {
+		return err
+	}
+
+	uploadKey, err := s.partialKey(bid, p)
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := s.fileKey(bid)
+	if err != nil {
+		return err
+	}
+
+	// the chunks are joined into a temporary object of the token, encoded
+	// if the file is stored compressed
+	c := &chunks{keys: keys, open: func(key string) (object, error) {
+		return s.openFile(key, uploadKey)
+	}}
+	h := sha256.New()
+	enc := s.encoding(name, p.E2E)
+	tmp, n, err := s.write(id, io.TeeReader(c, h), -1, enc, dataKey)
+	c.Close()
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if n != p.Size || (p.SHA256 != "" && p.SHA256 != sum) {
+		_ = s.files.remove(tmp)
+		s.dropUpload(bid, name)
+		return tokenshare.ChecksumMismatch{}
+	}
+
+	info := tokenshare.FileInfo{Name: name, Size: p.Size, T: time.Now(), SHA256: sum, Encoding: enc, Encrypted: dataKey != nil, E2E: p.E2E}
+	_, err = s.record(bid, tmp, info, dataKey, func(t *tokenshare.Token) {
+		t.DropPartial(name)
+	})
+	if err == nil {
+		if err := s.files.removeAll(partialDir(id, name)); err != nil {
+			log.Printf("remove %s: %v", name, err)
+		}
+		return nil
+	}
+
+	_ = s.files.remove(tmp)
+
+	// the upload is given up, it does not fit into the token anymore
+	s.dropUpload(bid, name)
+	return err
+}
+
+// dropUpload removes the chunks and forgets the upload of name.
+func (s *server) dropUpload(bid []byte, name string) {
+	if err := s.files.removeAll(partialDir(hex.EncodeToString(bid), name)); err != nil {
+		log.Printf("remove %s: %v", name, err)
+	}
+
+	if _, err := s.modify(bid, func(t *tokenshare.Token) error {
+		t.DropPartial(name)
+		return settle(t)
+	}); err != nil {
+		log.Printf("drop upload %s: %v", name, err)
+	}
+}
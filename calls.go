@@ -2,13 +2,21 @@ package tokenshare
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func MarshalList(t []Token) ([]byte, error) {
@@ -32,10 +40,21 @@ func UnmarshalList(d []byte) ([]Token, error) {
 }
 
 func Call(call string, cookie *http.Cookie, values map[string]string) ([]byte, error) {
-	req, err := http.NewRequest("GET", call, bytes.NewBuffer(nil))
+	return get(call, cookie, "", values)
+}
+
+// get is Call with the passphrase of a protected token.
+func get(call string, cookie *http.Cookie, passphrase string, values map[string]string) ([]byte, error) {
+	return do(http.MethodGet, call, cookie, passphrase, values)
+}
+
+// do sends a request without body, the values are sent in the query.
+func do(method, call string, cookie *http.Cookie, passphrase string, values map[string]string) ([]byte, error) {
+	req, err := http.NewRequest(method, call, bytes.NewBuffer(nil))
 	if err != nil {
 		return nil, err
 	}
+	setPassphrase(req, passphrase)
 
 	form, _ := url.ParseQuery(req.URL.RawQuery)
 	for k, v := range values {
@@ -64,11 +83,191 @@ func Call(call string, cookie *http.Cookie, values map[string]string) ([]byte, e
 	return buf, err
 }
 
-func Download(call, id string) ([]byte, error) {
+// setPassphrase sends passphrase with req, if it is not empty.
+func setPassphrase(req *http.Request, passphrase string) {
+	if passphrase != "" {
+		req.Header.Set(PassphraseHeader, passphrase)
+	}
+}
+
+// Download fetches the file called name from the token. The name may be
+// empty if the token holds a single file, the passphrase if the token is
+// not protected.
+func Download(call, id, name, passphrase string) ([]byte, error) {
 	m := make(map[string]string)
 	m[ID] = id
+	if name != "" {
+		m[Name] = name
+	}
+
+	return get(call, nil, passphrase, m)
+}
+
+// DownloadTo streams the file name of the token to w and returns the number
+// of bytes written. An interrupted transfer is resumed with a range request
+// from the last byte written, giving up after Retries failures in a row.
+// progress, if not nil, is called with the number of bytes written so far.
+func DownloadTo(call, id, name, passphrase string, w io.Writer, progress func(int64)) (int64, error) {
+	u, err := downloadURL(call, id, name)
+	if err != nil {
+		return 0, err
+	}
+
+	return fetch(u, passphrase, w, 0, progress)
+}
+
+// DownloadFile downloads the file name of the token to path. A file that
+// exists at path already is taken for the beginning of an earlier download
+// and continued.
+func DownloadFile(call, id, name, passphrase, path string, progress func(int64)) error {
+	u, err := downloadURL(call, id, name)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if _, err := fetch(u, passphrase, f, stat.Size(), progress); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func downloadURL(call, id, name string) (string, error) {
+	u, err := url.Parse(call)
+	if err != nil {
+		return "", err
+	}
+
+	form := u.Query()
+	form.Set(ID, id)
+	if name != "" {
+		form.Set(Name, name)
+	}
+	u.RawQuery = form.Encode()
+
+	return u.String(), nil
+}
+
+// errFatal wraps errors a download is not retried after.
+type errFatal struct {
+	err error
+}
+
+func (e errFatal) Error() string {
+	return e.err.Error()
+}
+
+// fetch downloads u to w, of which the first offset bytes have been
+// written already, and returns the number of bytes written in total.
+func fetch(u, passphrase string, w io.Writer, offset int64, progress func(int64)) (int64, error) {
+	// the Last-Modified header of the first response ensures that all
+	// ranges are taken from the same file
+	validator := ""
+	failures := 0
+
+	for {
+		n, done, err := fetchRange(u, passphrase, w, offset, &validator)
+		offset += n
+		if n > 0 {
+			failures = 0
+			if progress != nil {
+				progress(offset)
+			}
+		}
+
+		if err == nil && done {
+			return offset, nil
+		}
+
+		if fatal, ok := err.(errFatal); ok {
+			return offset, fatal.err
+		}
+
+		failures++
+		if failures > Retries {
+			return offset, err
+		}
+		time.Sleep(time.Duration(failures) * time.Second)
+	}
+}
+
+// fetchRange requests u from offset and copies the response to w. It
+// returns the number of bytes copied and whether the file is complete.
+func fetchRange(u, passphrase string, w io.Writer, offset int64, validator *string) (int64, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, false, errFatal{err}
+	}
+	setPassphrase(req, passphrase)
 
-	return Call(call, nil, m)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if *validator != "" {
+			req.Header.Set("If-Range", *validator)
+		}
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+	case resp.StatusCode == http.StatusOK && offset == 0:
+	case resp.StatusCode == http.StatusOK && *validator == "":
+		// the range was ignored, the part written already is skipped
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			return 0, false, err
+		}
+	case resp.StatusCode == http.StatusOK:
+		return 0, false, errFatal{errors.New("download: file changed while resuming")}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && resp.Header.Get("Content-Range") == fmt.Sprintf("bytes */%d", offset):
+		// the file was downloaded completely before
+		return 0, true, nil
+	default:
+		res, _ := ioutil.ReadAll(resp.Body)
+		return 0, false, errFatal{fmt.Errorf("download: %s: %s", resp.Status, string(res))}
+	}
+
+	if *validator == "" {
+		*validator = resp.Header.Get("Last-Modified")
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, false, err
+	}
+
+	// a body cut off between two reads may end without an error
+	if resp.ContentLength >= 0 && n < resp.ContentLength {
+		return n, false, io.ErrUnexpectedEOF
+	}
+
+	return n, true, nil
+}
+
+// DownloadArchive fetches all files of the token as a single archive in the
+// given format.
+func DownloadArchive(call, id string, format Archive, passphrase string) ([]byte, error) {
+	m := make(map[string]string)
+	m[ID] = id
+	m[Format] = string(format)
+
+	return get(call, nil, passphrase, m)
 }
 
 func List(call string, cookie *http.Cookie) ([]Token, error) {
@@ -80,8 +279,78 @@ func List(call string, cookie *http.Cookie) ([]Token, error) {
 	return UnmarshalList(buf)
 }
 
-func Create(call string, cookie *http.Cookie) (Token, error) {
+// GetUsage returns the storage usage reported to the admin.
+func GetUsage(call string, cookie *http.Cookie) (Usage, error) {
+	var u Usage
+
 	buf, err := Call(call, cookie, make(map[string]string))
+	if err != nil {
+		return u, err
+	}
+
+	err = json.Unmarshal(buf, &u)
+	return u, err
+}
+
+// CreateOptions holds the optional settings of a new token. The zero value
+// creates a token that never expires, accepts any number of files and may
+// be downloaded any number of times. A MaxDownloads of one creates a
+// self-destructing, download-once token.
+type CreateOptions struct {
+	TTL      time.Duration
+	MaxFiles int
+	MaxBytes int64
+	MaxSize  int64
+
+	MaxDownloads int
+
+	// Passphrase protects uploads to and downloads from the token.
+	Passphrase string
+
+	Label     string
+	Recipient string
+	Note      string
+
+	// ShowNote shows the note to the recipient, it is kept for the admin
+	// otherwise.
+	ShowNote bool
+}
+
+func (o CreateOptions) values() map[string]string {
+	m := make(map[string]string)
+	if o.TTL > 0 {
+		m[TTL] = o.TTL.String()
+	}
+	if o.MaxFiles > 0 {
+		m[MaxFiles] = strconv.Itoa(o.MaxFiles)
+	}
+	if o.MaxBytes > 0 {
+		m[MaxBytes] = strconv.FormatInt(o.MaxBytes, 10)
+	}
+	if o.MaxSize > 0 {
+		m[MaxSize] = strconv.FormatInt(o.MaxSize, 10)
+	}
+	if o.MaxDownloads > 0 {
+		m[MaxDownloads] = strconv.Itoa(o.MaxDownloads)
+	}
+	if o.Label != "" {
+		m[Label] = o.Label
+	}
+	if o.Recipient != "" {
+		m[Recipient] = o.Recipient
+	}
+	if o.Note != "" {
+		m[Note] = o.Note
+	}
+	if o.ShowNote {
+		m[ShowNote] = "true"
+	}
+
+	return m
+}
+
+func Create(call string, cookie *http.Cookie, opts CreateOptions) (Token, error) {
+	buf, err := get(call, cookie, opts.Passphrase, opts.values())
 	if err != nil {
 		return Token{}, err
 	}
@@ -94,51 +363,147 @@ func Create(call string, cookie *http.Cookie) (Token, error) {
 	return token, nil
 }
 
-func Transfer(call, name, id string, data []byte, progress chan int) error {
+// Delete removes the token and all files uploaded to it.
+func Delete(call string, cookie *http.Cookie, id string) error {
+	m := make(map[string]string)
+	m[ID] = id
+
+	_, err := do(http.MethodPost, call, cookie, "", m)
+	return err
+}
+
+// Revoke invalidates the token and removes its files. Unlike Delete, the
+// token remains listed with status revoked.
+func Revoke(call string, cookie *http.Cookie, id string) error {
+	m := make(map[string]string)
+	m[ID] = id
+
+	_, err := do(http.MethodPost, call, cookie, "", m)
+	return err
+}
+
+func Transfer(call, name, id, passphrase string, data []byte, progress chan int) error {
+	m := make(map[string]string)
+	m[ID] = id
+
+	_, err := post(call, nil, passphrase, m, name, data, progress)
+	return err
+}
+
+// Put uploads data as the file name of the token with a plain PUT request,
+// call is the address of ReqPut.
+func Put(call, id, name, passphrase string, data []byte, progress chan int) error {
+	u, err := url.Parse(call)
+	if err != nil {
+		return err
+	}
+	u = u.ResolveReference(&url.URL{Path: id + "/" + name})
+
+	form := url.Values{}
+	sum := sha256.Sum256(data)
+	form.Set(SHA256, hex.EncodeToString(sum[:]))
+	u.RawQuery = form.Encode()
+
+	request, err := http.NewRequest(http.MethodPut, u.String(), &progressReader{bytes.NewReader(data), progress})
+	if err != nil {
+		return err
+	}
+	request.ContentLength = int64(len(data))
+	setPassphrase(request, passphrase)
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("upload: %s", string(res))
+	}
+
+	return nil
+}
+
+// Share uploads a file as admin and returns the new share token, whose
+// recipient link points to ReqReceive.
+func Share(call string, cookie *http.Cookie, name string, data []byte, opts CreateOptions, progress chan int) (Token, error) {
+	buf, err := post(call, cookie, opts.Passphrase, opts.values(), name, data, progress)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return Unmarshal(buf)
+}
+
+// post uploads data as multipart form file. The values are sent in the
+// query, so the server can check them before it reads the body.
+func post(call string, cookie *http.Cookie, passphrase string, values map[string]string, name string, data []byte, progress chan int) ([]byte, error) {
 	body := bytes.NewBuffer(nil)
 	writer := multipart.NewWriter(body)
 
 	part, err := writer.CreateFormFile(File, name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	buf := bytes.NewBuffer(data)
 	_, err = io.Copy(part, buf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if err := writer.WriteField(ID, id); err != nil {
-		return err
+	if err := writer.Close(); err != nil {
+		return nil, err
 	}
 
-	if err := writer.Close(); err != nil {
-		return err
+	u, err := url.Parse(call)
+	if err != nil {
+		return nil, err
 	}
+	form := u.Query()
+	for k, v := range values {
+		form.Set(k, v)
+	}
+	sum := sha256.Sum256(data)
+	form.Set(SHA256, hex.EncodeToString(sum[:]))
+	u.RawQuery = form.Encode()
 
+	size := int64(body.Len())
 	pr := &progressReader{body, progress}
-	request, err := http.NewRequest("POST", call, pr)
+	request, err := http.NewRequest("POST", u.String(), pr)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	request.ContentLength = size
 	request.Header.Set("Content-Type", writer.FormDataContentType())
+	setPassphrase(request, passphrase)
+
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
 
 	client := http.Client{}
 	resp, err := client.Do(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		buf, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
+	defer resp.Body.Close()
 
-		return fmt.Errorf("upload: %s", string(buf))
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upload: %s", string(res))
+	}
+
+	return res, nil
 }
 
 type progressReader struct {
@@ -154,3 +519,281 @@ func (pr *progressReader) Read(p []byte) (int, error) {
 
 	return n, err
 }
+
+const (
+	// ChunkSize is the size of the chunks sent by Resume.
+	ChunkSize = 4 * 1024 * 1024
+	// Retries is the number of times Resume retries a failed chunk before
+	// it gives up.
+	Retries = 5
+
+	tusVersion = "1.0.0"
+)
+
+var errNoUpload = errors.New("no such upload")
+
+// Resume uploads size bytes from r with the resumable upload protocol. An
+// upload of the same name that was cut off earlier, in this or a previous
+// call, continues from the last offset acknowledged by the server. The call
+// is the URL of ReqResumable.
+func Resume(call, name, id, passphrase string, r io.ReadSeeker, size int64, progress chan int) error {
+	return resume(call, name, id, passphrase, r, size, nil, progress)
+}
+
+// ResumeE2E is Resume for a file encrypted by the sender, r holds the
+// ciphertext.
+func ResumeE2E(call, name, id, passphrase string, r io.ReadSeeker, e E2E, progress chan int) error {
+	return resume(call, name, id, passphrase, r, e.SealedSize(), &e, progress)
+}
+
+func resume(call, name, id, passphrase string, r io.ReadSeeker, size int64, e *E2E, progress chan int) error {
+	base, err := url.Parse(call)
+	if err != nil {
+		return err
+	}
+
+	// an earlier upload is looked up under the name the server stored it
+	name = StoredName(name)
+
+	upload := base.ResolveReference(&url.URL{Path: id + "/" + name})
+
+	// the digest is announced up front and checked by the server once the
+	// last chunk arrived
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, r, size); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// an earlier upload of the same name only continues if it was of the
+	// same content, otherwise it is replaced
+	var encryption string
+	if e != nil {
+		encryption = e.Encode()
+	}
+
+	offset, length, meta, err := tusHead(upload.String(), passphrase)
+	if err == nil && (length != size || meta[SHA256] != sum || meta[Encryption] != encryption) {
+		err = errNoUpload
+	}
+	if err == errNoUpload {
+		// the server may store the file under a different name, the
+		// upload continues at the location it returns
+		var location *url.URL
+		location, err = tusCreate(base, id, passphrase, name, size, sum, e)
+		if err == nil {
+			upload = base.ResolveReference(location)
+			offset = 0
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if progress != nil && offset > 0 {
+		progress <- int(offset)
+	}
+
+	failures := 0
+	for offset < size {
+		next, err := tusPatch(upload.String(), passphrase, r, offset, size)
+		if err == nil {
+			if progress != nil {
+				progress <- int(next - offset)
+			}
+
+			offset = next
+			failures = 0
+			continue
+		}
+
+		failures++
+		if failures > Retries {
+			return err
+		}
+		time.Sleep(time.Duration(failures) * time.Second)
+
+		// the server may have stored part of the failed chunk
+		next, err = tusOffset(upload.String(), passphrase)
+		if err != nil {
+			continue
+		}
+
+		if progress != nil && next > offset {
+			progress <- int(next - offset)
+		}
+		offset = next
+	}
+
+	return nil
+}
+
+func tusRequest(method, call, passphrase string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, call, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Tus-Resumable", tusVersion)
+	setPassphrase(req, passphrase)
+
+	return req, nil
+}
+
+func tusDo(req *http.Request, status int) (*http.Response, error) {
+	client := http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound && req.Method == http.MethodHead {
+		return nil, errNoUpload
+	}
+
+	if resp.StatusCode != status {
+		return nil, fmt.Errorf("upload: %s: %s", resp.Status, string(buf))
+	}
+
+	return resp, nil
+}
+
+// tusOffset asks for the acknowledged offset of an upload. It returns
+// errNoUpload if the upload has not been created.
+func tusOffset(upload, passphrase string) (int64, error) {
+	offset, _, _, err := tusHead(upload, passphrase)
+	return offset, err
+}
+
+// tusHead is tusOffset, but returns the length and the metadata of the
+// upload as well.
+func tusHead(upload, passphrase string) (int64, int64, map[string]string, error) {
+	req, err := tusRequest(http.MethodHead, upload, passphrase, nil)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	resp, err := tusDo(req, http.StatusOK)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, err := strconv.ParseInt(resp.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	meta, err := ParseUploadMetadata(resp.Header.Get("Upload-Metadata"))
+	return offset, length, meta, err
+}
+
+// StoredName returns the name the server stores a file sent as name
+// under, unless it rejects the name: path components of either separator
+// are stripped, as are leading and trailing spaces and trailing dots.
+func StoredName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+
+	return strings.TrimRight(strings.TrimSpace(name), ". ")
+}
+
+// UploadMetadata encodes the Upload-Metadata header of a resumable upload
+// of name with the digest sum, encrypted by the sender if e is not nil.
+func UploadMetadata(name, sum string, e *E2E) string {
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte(name))
+	if sum != "" {
+		meta += "," + SHA256 + " " + base64.StdEncoding.EncodeToString([]byte(sum))
+	}
+	if e != nil {
+		meta += "," + Encryption + " " + base64.StdEncoding.EncodeToString([]byte(e.Encode()))
+	}
+
+	return meta
+}
+
+// ParseUploadMetadata parses the Upload-Metadata header: comma separated
+// pairs of a key and a base64 encoded value.
+func ParseUploadMetadata(header string) (map[string]string, error) {
+	m := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		kv := strings.Fields(pair)
+		switch len(kv) {
+		case 0:
+			continue
+		case 1:
+			m[kv[0]] = ""
+		case 2:
+			v, err := base64.StdEncoding.DecodeString(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("metadata %s: %v", kv[0], err)
+			}
+			m[kv[0]] = string(v)
+		default:
+			return nil, fmt.Errorf("invalid metadata: %s", pair)
+		}
+	}
+
+	return m, nil
+}
+
+// tusCreate announces an upload and returns its location.
+func tusCreate(base *url.URL, id, passphrase, name string, size int64, sum string, e *E2E) (*url.URL, error) {
+	u := base.ResolveReference(&url.URL{Path: id})
+
+	req, err := tusRequest(http.MethodPost, u.String(), passphrase, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(size, 10))
+	req.Header.Set("Upload-Metadata", UploadMetadata(name, sum, e))
+
+	resp, err := tusDo(req, http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+
+	return url.Parse(resp.Header.Get("Location"))
+}
+
+// tusPatch sends the chunk at offset and returns the new offset.
+func tusPatch(upload, passphrase string, r io.ReadSeeker, offset, size int64) (int64, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n := size - offset
+	if n > ChunkSize {
+		n = ChunkSize
+	}
+
+	req, err := tusRequest(http.MethodPatch, upload, passphrase, io.LimitReader(r, n))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = n
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+
+	resp, err := tusDo(req, http.StatusNoContent)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+}
@@ -1,9 +1,14 @@
 package tokenshare
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"html"
+	"log"
 	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/gopherjs/gopherjs/js"
@@ -47,10 +52,50 @@ func (c Client) List(div *dom.HTMLDivElement) error {
 	return nil
 }
 
+// Usage shows the storage usage in div.
+func (c Client) Usage(div *dom.HTMLDivElement) error {
+	u, err := GetUsage(ReqUsage, nil)
+	if err != nil {
+		return err
+	}
+
+	parts := []string{"storage: " + quotaText(u.Used, u.Quota)}
+	parts = append(parts, u.Admin+": "+quotaText(u.AdminUsed, u.AdminQuota))
+	if u.Free >= 0 {
+		parts = append(parts, byteSize(u.Free)+" free on disk")
+	}
+
+	div.SetTextContent(strings.Join(parts, ", "))
+	return nil
+}
+
+func quotaText(used, quota int64) string {
+	if quota == 0 {
+		return byteSize(used) + " used"
+	}
+
+	return fmt.Sprintf("%s of %s used", byteSize(used), byteSize(quota))
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
 func (c Client) tokUrl(call string, tok Token) string {
 	u := c.Url()
 	form, _ := url.ParseQuery(u.RawQuery)
-	form.Add(ID, hex.EncodeToString(tok.ID))
+	form.Set(ID, tok.Key())
 	u.RawQuery = form.Encode()
 	u.Path = call
 
@@ -58,49 +103,294 @@ func (c Client) tokUrl(call string, tok Token) string {
 }
 
 func (c Client) tokDownloadUrl(tok Token) string {
-	if tok.Name == "" {
-		return ""
+	link := func(key, value, text string) string {
+		u, _ := url.Parse(c.tokUrl("download", tok))
+		form := u.Query()
+		form.Set(key, value)
+		u.RawQuery = form.Encode()
+
+		return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(u.String()), html.EscapeString(text))
+	}
+
+	// archives of files encrypted by their sender would hold ciphertext
+	links := make([]string, 0, len(tok.Files)+1)
+	sealed := false
+	for _, f := range tok.Files {
+		if f.E2E != nil {
+			links = append(links, link(Name, f.Name, f.Name)+" (end-to-end encrypted)")
+			sealed = true
+			continue
+		}
+		links = append(links, link(Name, f.Name, f.Name))
+	}
+
+	if len(tok.Files) > 1 && !sealed {
+		links = append(links, "all as "+link(Format, string(ArchiveZip), string(ArchiveZip))+" "+link(Format, string(ArchiveTarGz), string(ArchiveTarGz)))
 	}
 
-	return fmt.Sprintf(`<a href="%s">%s</a>`, c.tokUrl("download", tok), tok.Name)
+	return strings.Join(links, "<br>")
 }
 
 func (c Client) createRow(tok Token, row *dom.HTMLTableRowElement) {
-	u := c.tokUrl("upload", tok)
-
 	cell := row.InsertCell(0)
-	cell.SetInnerHTML(hex.EncodeToString(tok.ID[:4]))
+	cell.SetTextContent(c.tokShort(tok))
 
 	cell = row.InsertCell(1)
-	cell.SetInnerHTML(c.tokDownloadUrl(tok))
+	cell.SetTextContent(string(tok.State()))
 
 	cell = row.InsertCell(2)
-	cell.SetInnerHTML(tok.T.String())
+	cell.SetTextContent(tok.Label)
 
 	cell = row.InsertCell(3)
-	cell.SetInnerHTML(fmt.Sprintf(`<a href="%s">Upload Page</a>`, u))
+	cell.SetTextContent(tok.Recipient)
+
+	cell = row.InsertCell(4)
+	cell.SetTextContent(tok.Note)
+
+	cell = row.InsertCell(5)
+	cell.SetInnerHTML(c.tokDownloadUrl(tok))
+	if tok.MaxDownloads > 0 {
+		cell.AppendChild(dom.GetWindow().Document().CreateTextNode(fmt.Sprintf(" (%d/%d downloads)", tok.Downloads, tok.MaxDownloads)))
+	}
+
+	cell = row.InsertCell(6)
+	cell.SetInnerHTML(tok.T.String())
+
+	cell = row.InsertCell(7)
+	cell.SetInnerHTML(c.tokExpires(tok))
+
+	cell = row.InsertCell(8)
+	cell.SetInnerHTML(c.tokPage(tok))
+
+	cell = row.InsertCell(9)
+	if tok.State() != StatusRevoked && tok.State() != StatusExpired {
+		cell.AppendChild(c.revokeButton(tok, row))
+	}
+
+	cell = row.InsertCell(10)
+	cell.AppendChild(c.deleteButton(tok, row))
 }
 
-func (c Client) Create(div *dom.HTMLDivElement) error {
-	tok, err := Create(ReqCreate, nil)
+func (c Client) deleteButton(tok Token, row *dom.HTMLTableRowElement) *dom.HTMLButtonElement {
+	d := dom.GetWindow().Document()
+
+	button := d.CreateElement("button").(*dom.HTMLButtonElement)
+	button.SetTextContent("Delete")
+	button.AddEventListener("click", false, func(_ dom.Event) {
+		go func() {
+			if err := Delete(ReqDelete, nil, tok.Key()); err != nil {
+				log.Printf("delete: %v", err)
+				return
+			}
+
+			row.ParentNode().RemoveChild(row)
+		}()
+	})
+
+	return button
+}
+
+func (c Client) revokeButton(tok Token, row *dom.HTMLTableRowElement) *dom.HTMLButtonElement {
+	d := dom.GetWindow().Document()
+
+	button := d.CreateElement("button").(*dom.HTMLButtonElement)
+	button.SetTextContent("Revoke")
+	button.AddEventListener("click", false, func(_ dom.Event) {
+		go func() {
+			if err := Revoke(ReqRevoke, nil, tok.Key()); err != nil {
+				log.Printf("revoke: %v", err)
+				return
+			}
+
+			tok.Status = StatusRevoked
+			tok.Files = nil
+			row.SetInnerHTML("")
+			c.createRow(tok, row)
+		}()
+	})
+
+	return button
+}
+
+// tokShort abbreviates hex codes, other codes are meant to be read out and
+// are shown in full.
+func (c Client) tokShort(tok Token) string {
+	key := tok.Key()
+	if key == hex.EncodeToString(tok.ID) && len(key) > 8 {
+		return key[:8]
+	}
+
+	return key
+}
+
+// tokPage links the page handed out for the token: the upload page for
+// requests and the download page for shares.
+func (c Client) tokPage(tok Token) string {
+	if tok.Kind == KindShare {
+		return fmt.Sprintf(`<a href="%s">Recipient Link</a>`, html.EscapeString(c.tokUrl(ReqReceive, tok)))
+	}
+
+	return fmt.Sprintf(`<a href="%s">Upload Page</a>`, html.EscapeString(c.tokUrl(ReqUpload, tok)))
+}
+
+func (c Client) tokExpires(tok Token) string {
+	if tok.Expires.IsZero() {
+		return "never"
+	}
+
+	return tok.Expires.String()
+}
+
+func (c Client) Create(div *dom.HTMLDivElement, opts CreateOptions) error {
+	tok, err := Create(ReqCreate, nil, opts)
 	if err != nil {
 		return err
 	}
 
+	c.appendRow(div, tok)
+	return nil
+}
+
+// Share uploads a file as admin and adds the resulting share token to the
+// table in div.
+func (c Client) Share(p []byte, name string, opts CreateOptions, div, progress *dom.HTMLDivElement) error {
+	report := c.progress(len(p), progress)
+
+	pr := c.track(report)
+	defer close(pr)
+
+	tok, err := Share(ReqShare, nil, name, p, opts, pr)
+	if err != nil {
+		return err
+	}
+
+	report(len(p))
+	c.appendRow(div, tok)
+	return nil
+}
+
+func (c Client) appendRow(div *dom.HTMLDivElement, tok Token) {
 	table := div.ChildNodes()[0].(*dom.HTMLTableElement)
 	d := dom.GetWindow().Document()
 	row := d.CreateElement("tr").(*dom.HTMLTableRowElement)
 	c.createRow(tok, row)
 	table.AppendChild(row)
+}
+
+// Receive lists the files of the token for its recipient. Files encrypted
+// by their sender are decrypted in the browser with the key from the
+// fragment of the page. The passphrase of a protected token is sent in a
+// header, so its links are fetched by the page as well.
+func (c Client) Receive(tok Token, passphrase string, div *dom.HTMLDivElement) {
+	if len(tok.Files) == 0 {
+		div.SetInnerHTML("no files yet")
+		return
+	}
+
+	div.SetInnerHTML(c.tokDownloadUrl(tok))
 
+	for _, a := range div.GetElementsByTagName("a") {
+		u, err := url.Parse(a.GetAttribute("href"))
+		if err != nil {
+			continue
+		}
+
+		name, format := u.Query().Get(Name), Archive(u.Query().Get(Format))
+		f, _ := tok.File(name)
+		if passphrase == "" && f.E2E == nil {
+			continue
+		}
+
+		a.AddEventListener("click", false, func(event dom.Event) {
+			event.PreventDefault()
+			go func() {
+				if err := c.save(tok, f, format, passphrase); err != nil {
+					dom.GetWindow().Alert(fmt.Sprintf("%s: %v", name+string(format), err))
+				}
+			}()
+		})
+	}
+}
+
+// E2EKey returns the key in the fragment of the page, nil if it has none.
+func (c Client) E2EKey() ([]byte, error) {
+	return ParseE2EKey(c.Url().Fragment)
+}
+
+// SetE2EKey puts key into the fragment of the page, so that links derived
+// from it carry the key.
+func (c Client) SetE2EKey(key []byte) {
+	u, _ := url.Parse(E2ELink(c.Url().String(), key))
+	js.Global.Get("location").Set("hash", u.Fragment)
+}
+
+// save downloads f, or the archive of all files if format is set, and
+// hands it to the browser as a file to save. End-to-end encrypted files
+// are decrypted first.
+func (c Client) save(tok Token, f FileInfo, format Archive, passphrase string) error {
+	if format != "" {
+		data, err := DownloadArchive(ReqDownload, tok.Key(), format, passphrase)
+		if err != nil {
+			return err
+		}
+
+		return saveBlob(data, tok.Key()+"."+string(format))
+	}
+
+	data, err := Download(ReqDownload, tok.Key(), f.Name, passphrase)
+	if err != nil {
+		return err
+	}
+
+	if f.E2E == nil {
+		return saveBlob(data, f.Name)
+	}
+
+	key, err := c.E2EKey()
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		return errors.New("the file is end-to-end encrypted, but the link lacks its key")
+	}
+
+	plain, err := webOpen(key, data, *f.E2E)
+	if err != nil {
+		return err
+	}
+
+	return saveBlob(plain, f.Name)
+}
+
+// saveBlob hands data to the browser as a file called name to save.
+func saveBlob(data []byte, name string) error {
+	blob := js.Global.Get("Blob").New([]interface{}{data}, map[string]interface{}{"type": "application/octet-stream"})
+	u := js.Global.Get("URL").Call("createObjectURL", blob)
+
+	// Firefox only follows links within the document, and starts the
+	// download after the click returned
+	doc := dom.GetWindow().Document()
+	a := doc.CreateElement("a").(*dom.HTMLAnchorElement)
+	a.SetAttribute("href", u.String())
+	a.SetAttribute("download", name)
+	doc.(dom.HTMLDocument).Body().AppendChild(a)
+	a.Click()
+
+	dom.GetWindow().SetTimeout(func() {
+		a.ParentNode().RemoveChild(a)
+		js.Global.Get("URL").Call("revokeObjectURL", u)
+	}, 60*1000)
 	return nil
 }
 
-func (c Client) Single(id string) (Token, bool, error) {
+// Single fetches the token. Without the passphrase of a protected token
+// only its ID, kind and dates are returned.
+func (c Client) Single(id, passphrase string) (Token, bool, error) {
 	m := make(map[string]string)
 	m[ID] = id
 
-	buf, err := Call(ReqSingle, nil, m)
+	buf, err := get(ReqSingle, nil, passphrase, m)
 	if err != nil {
 		return Token{}, false, err
 	}
@@ -146,12 +436,12 @@ func (c Client) Open(input *dom.HTMLInputElement, res *OpenResult) {
 	wg.Add(1)
 
 	fileReader := js.Global.Get("FileReader").New()
-	fileReader.Set("onload", c.open(res, file, fileReader, wg))
+	fileReader.Set("onload", c.open(res, file, fileReader, &wg))
 	fileReader.Call("readAsArrayBuffer", file)
 	wg.Wait()
 }
 
-func (c Client) open(res *OpenResult, file, fileReader *js.Object, wg sync.WaitGroup) func() {
+func (c Client) open(res *OpenResult, file, fileReader *js.Object, wg *sync.WaitGroup) func() {
 	return func() {
 		defer wg.Done()
 		name := file.Get("name").String()
@@ -163,8 +453,28 @@ func (c Client) open(res *OpenResult, file, fileReader *js.Object, wg sync.WaitG
 	}
 }
 
-func (c Client) Upload(p []byte, name, id string, progress *dom.HTMLDivElement) error {
-	return c.upload(p, name, id, c.progress(len(p), progress))
+func (c Client) Upload(p []byte, name, id, passphrase string, progress *dom.HTMLDivElement) error {
+	return c.upload(p, name, id, passphrase, c.progress(len(p), progress))
+}
+
+// UploadE2E encrypts p with key before it is uploaded, the server only
+// receives the ciphertext.
+func (c Client) UploadE2E(p []byte, name, id, passphrase string, key []byte, progress *dom.HTMLDivElement) error {
+	sealed, e, err := webSeal(key, p)
+	if err != nil {
+		return err
+	}
+
+	report := c.progress(len(sealed), progress)
+	pr := c.track(report)
+	defer close(pr)
+
+	if err := ResumeE2E(ReqResumable, name, id, passphrase, bytes.NewReader(sealed), e, pr); err != nil {
+		return err
+	}
+
+	report(len(sealed))
+	return nil
 }
 
 func (c Client) progress(total int, div *dom.HTMLDivElement) func(int) {
@@ -173,20 +483,126 @@ func (c Client) progress(total int, div *dom.HTMLDivElement) func(int) {
 	}
 }
 
-func (c Client) upload(data []byte, name, id string, progress func(int)) error {
+// track passes the total number of bytes sent on the returned channel to
+// progress. The caller closes the channel.
+func (c Client) track(progress func(int)) chan int {
 	pr := make(chan int)
-	defer close(pr)
 
 	go func() {
-		for i := range pr {
-			progress(i)
+		sent := 0
+		for n := range pr {
+			sent += n
+			progress(sent)
 		}
 	}()
 
-	if err := Transfer(ReqTransfer, name, id, data, pr); err != nil {
+	return pr
+}
+
+// upload sends data with the resumable protocol, so a retried upload of the
+// same file continues where the last one stopped.
+func (c Client) upload(data []byte, name, id, passphrase string, progress func(int)) error {
+	pr := c.track(progress)
+	defer close(pr)
+
+	r := bytes.NewReader(data)
+	if err := Resume(ReqResumable, name, id, passphrase, r, int64(len(data)), pr); err != nil {
 		return err
 	}
 
 	progress(len(data))
 	return nil
 }
+
+// await blocks until promise settles and returns its value.
+func await(promise *js.Object) (*js.Object, error) {
+	type result struct {
+		v   *js.Object
+		err error
+	}
+
+	ch := make(chan result, 1)
+	promise.Call("then", func(v *js.Object) {
+		ch <- result{v: v}
+	}, func(e *js.Object) {
+		ch <- result{err: fmt.Errorf("%s", e.String())}
+	})
+
+	res := <-ch
+	return res.v, res.err
+}
+
+// webKey imports key into WebCrypto.
+func webKey(key []byte) (*js.Object, error) {
+	return await(js.Global.Get("crypto").Get("subtle").Call("importKey", "raw", key, "AES-GCM", false, []string{"encrypt", "decrypt"}))
+}
+
+// webChunk encrypts or decrypts chunk i of a file with WebCrypto.
+func webChunk(op string, key *js.Object, e E2E, i int64, data []byte) ([]byte, error) {
+	params := map[string]interface{}{"name": "AES-GCM", "iv": e.IV(i), "additionalData": e.AD(i)}
+	buf, err := await(js.Global.Get("crypto").Get("subtle").Call(op, params, key, data))
+	if err != nil {
+		return nil, err
+	}
+
+	return js.Global.Get("Uint8Array").New(buf).Interface().([]byte), nil
+}
+
+// webSeal is SealE2E implemented with WebCrypto.
+func webSeal(key, data []byte) ([]byte, E2E, error) {
+	e, err := NewE2E(int64(len(data)))
+	if err != nil {
+		return nil, E2E{}, err
+	}
+
+	k, err := webKey(key)
+	if err != nil {
+		return nil, E2E{}, err
+	}
+
+	res := make([]byte, 0, e.SealedSize())
+	for i := int64(0); i < e.Chunks(); i++ {
+		n := len(data)
+		if n > e.Chunk {
+			n = e.Chunk
+		}
+
+		chunk, err := webChunk("encrypt", k, e, i, data[:n])
+		if err != nil {
+			return nil, E2E{}, err
+		}
+		res = append(res, chunk...)
+		data = data[n:]
+	}
+
+	return res, e, nil
+}
+
+// webOpen is OpenE2E implemented with WebCrypto.
+func webOpen(key, data []byte, e E2E) ([]byte, error) {
+	if err := e.Check(int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	k, err := webKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, e.Size)
+	for i := int64(0); i < e.Chunks(); i++ {
+		n := len(data)
+		if n > e.Chunk+e2eOverhead {
+			n = e.Chunk + e2eOverhead
+		}
+
+		chunk, err := webChunk("decrypt", k, e, i, data[:n])
+		if err != nil {
+			return nil, fmt.Errorf("e2e: chunk %d: %v", i, err)
+		}
+		res = append(res, chunk...)
+		data = data[n:]
+	}
+
+	return res, nil
+}
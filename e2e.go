@@ -0,0 +1,226 @@
+package tokenshare
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Files can be encrypted by their sender, so the server only ever sees
+// ciphertext. The key is a random AES-256 key that travels in the fragment
+// of the links to the token, which browsers never send to the server.
+//
+// A file is sealed with AES-GCM in chunks of E2E.Chunk bytes. The nonce of
+// chunk i is the random 8 byte nonce of the file followed by i as 32 bit
+// big endian number, the additional data is 1 for the last chunk and 0 for
+// all others, so chunks can neither be reordered nor cut off. Browsers
+// implement the same with WebCrypto.
+const (
+	// E2EChunk is the chunk size files are sealed with.
+	E2EChunk = 64 * 1024
+	// E2EFragment is the parameter of the link fragment holding the key.
+	E2EFragment = "key"
+
+	e2eNonce    = 8
+	e2eOverhead = 16
+)
+
+// E2E is what the recipient of a file encrypted by its sender needs
+// besides the key to decrypt it.
+type E2E struct {
+	// Nonce is the base64 encoded nonce of the file.
+	Nonce string `json:"nonce"`
+	Chunk int    `json:"chunk"`
+	// Size is the size of the plain file.
+	Size int64 `json:"size"`
+}
+
+// NewE2EKey returns a new random key.
+func NewE2EKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// E2ELink returns link with key set in its fragment.
+func E2ELink(link string, key []byte) string {
+	u, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+
+	u.Fragment = E2EFragment + "=" + base64.RawURLEncoding.EncodeToString(key)
+	return u.String()
+}
+
+// ParseE2EKey returns the key in the fragment of a link, nil if there is
+// none.
+func ParseE2EKey(fragment string) ([]byte, error) {
+	form, err := url.ParseQuery(strings.TrimPrefix(fragment, "#"))
+	if err != nil {
+		return nil, err
+	}
+
+	enc := form.Get(E2EFragment)
+	if enc == "" {
+		return nil, nil
+	}
+
+	key, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("invalid key in link")
+	}
+
+	return key, nil
+}
+
+// NewE2E returns the parameters of a new file of size bytes.
+func NewE2E(size int64) (E2E, error) {
+	nonce := make([]byte, e2eNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return E2E{}, err
+	}
+
+	return E2E{Nonce: base64.StdEncoding.EncodeToString(nonce), Chunk: E2EChunk, Size: size}, nil
+}
+
+// Chunks returns the number of chunks of the file, an empty file has an
+// empty one.
+func (e E2E) Chunks() int64 {
+	if e.Size == 0 {
+		return 1
+	}
+
+	return (e.Size + int64(e.Chunk) - 1) / int64(e.Chunk)
+}
+
+// SealedSize returns the size of the encrypted file.
+func (e E2E) SealedSize() int64 {
+	return e.Size + e.Chunks()*e2eOverhead
+}
+
+// IV returns the nonce of chunk i.
+func (e E2E) IV(i int64) []byte {
+	nonce, _ := base64.StdEncoding.DecodeString(e.Nonce)
+	iv := make([]byte, e2eNonce+4)
+	copy(iv, nonce)
+	binary.BigEndian.PutUint32(iv[e2eNonce:], uint32(i))
+
+	return iv
+}
+
+// AD returns the additional data of chunk i.
+func (e E2E) AD(i int64) []byte {
+	if i == e.Chunks()-1 {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+// Check reports whether the parameters are valid for an encrypted file of
+// size bytes.
+func (e E2E) Check(size int64) error {
+	nonce, err := base64.StdEncoding.DecodeString(e.Nonce)
+	switch {
+	case err != nil || len(nonce) != e2eNonce:
+		return fmt.Errorf("e2e: invalid nonce")
+	case e.Chunk <= 0 || e.Chunk > 16*1024*1024:
+		return fmt.Errorf("e2e: invalid chunk size %d", e.Chunk)
+	case e.Size < 0 || e.Chunks() > 1<<32:
+		return fmt.Errorf("e2e: invalid size %d", e.Size)
+	case e.SealedSize() != size:
+		return fmt.Errorf("e2e: %d bytes received, want %d", size, e.SealedSize())
+	}
+
+	return nil
+}
+
+// Encode returns the parameters as sent with an upload.
+func (e E2E) Encode() string {
+	buf, _ := json.Marshal(e)
+	return string(buf)
+}
+
+// ParseE2E decodes parameters sent with an upload.
+func ParseE2E(s string) (*E2E, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var e E2E
+	if err := json.Unmarshal([]byte(s), &e); err != nil {
+		return nil, fmt.Errorf("e2e: %v", err)
+	}
+
+	return &e, nil
+}
+
+// SealE2E encrypts data with key. It is the counterpart of the browser
+// implementation for other clients.
+func SealE2E(key, data []byte) ([]byte, E2E, error) {
+	e, err := NewE2E(int64(len(data)))
+	if err != nil {
+		return nil, E2E{}, err
+	}
+
+	aead, err := e2eCipher(key)
+	if err != nil {
+		return nil, E2E{}, err
+	}
+
+	res := make([]byte, 0, e.SealedSize())
+	for i := int64(0); i < e.Chunks(); i++ {
+		n := len(data)
+		if n > e.Chunk {
+			n = e.Chunk
+		}
+
+		res = aead.Seal(res, e.IV(i), data[:n], e.AD(i))
+		data = data[n:]
+	}
+
+	return res, e, nil
+}
+
+// OpenE2E decrypts data sealed with key.
+func OpenE2E(key, data []byte, e E2E) ([]byte, error) {
+	if err := e.Check(int64(len(data))); err != nil {
+		return nil, err
+	}
+
+	aead, err := e2eCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, e.Size)
+	for i := int64(0); i < e.Chunks(); i++ {
+		n := len(data)
+		if n > e.Chunk+e2eOverhead {
+			n = e.Chunk + e2eOverhead
+		}
+
+		if res, err = aead.Open(res, e.IV(i), data[:n], e.AD(i)); err != nil {
+			return nil, fmt.Errorf("e2e: chunk %d: %v", i, err)
+		}
+		data = data[n:]
+	}
+
+	return res, nil
+}
+
+func e2eCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
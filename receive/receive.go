@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jostillmanns/tokenshare"
+	"honnef.co/go/js/dom"
+)
+
+var (
+	divFiles      *dom.HTMLDivElement
+	divMessage    *dom.HTMLDivElement
+	divUnlock     *dom.HTMLDivElement
+	inpPassphrase *dom.HTMLInputElement
+	pNote         *dom.HTMLParagraphElement
+)
+
+func main() {
+	d := dom.GetWindow().Document()
+	divFiles = d.GetElementByID("files").(*dom.HTMLDivElement)
+	divMessage = d.GetElementByID("message").(*dom.HTMLDivElement)
+	divUnlock = d.GetElementByID("unlock").(*dom.HTMLDivElement)
+	inpPassphrase = d.GetElementByID("passphrase").(*dom.HTMLInputElement)
+	pNote = d.GetElementByID("note").(*dom.HTMLParagraphElement)
+
+	butOpen := d.GetElementByID("open").(*dom.HTMLButtonElement)
+	butOpen.AddEventListener("click", false, func(_ dom.Event) {
+		go receive(inpPassphrase.Value)
+	})
+
+	go receive("")
+}
+
+func message(m string) {
+	divMessage.SetTextContent(m)
+}
+
+func receive(passphrase string) {
+	client := tokenshare.Client{}
+
+	ids := client.Url().Query()[tokenshare.ID]
+	if len(ids) == 0 || ids[0] == "" {
+		message("id not set")
+		return
+	}
+
+	tok, _, err := client.Single(ids[0], passphrase)
+	if err != nil {
+		message(fmt.Sprintf("unable to query token: %v", err))
+		return
+	}
+
+	// a protected token is only summarized until the passphrase is given
+	if tok.Protected && passphrase == "" {
+		divUnlock.RemoveAttribute("hidden")
+		return
+	}
+
+	divUnlock.SetAttribute("hidden", "")
+	message("")
+	pNote.SetTextContent(tok.Note)
+	client.Receive(tok, passphrase, divFiles)
+}
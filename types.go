@@ -1,23 +1,352 @@
 package tokenshare
 
-import "time"
+import (
+	"encoding/hex"
+	"time"
+)
+
+// Kind tells apart the direction of a token.
+type Kind string
+
+const (
+	// KindRequest tokens are created by the admin to request files from an
+	// outside party, who uploads to them.
+	KindRequest Kind = "request"
+	// KindShare tokens are created by the admin together with a file, the
+	// recipient downloads from them.
+	KindShare Kind = "share"
+)
+
+// Status is the lifecycle state of a token.
+type Status string
+
+const (
+	StatusCreated    Status = "created"
+	StatusUploading  Status = "uploading"
+	StatusComplete   Status = "complete"
+	StatusDownloaded Status = "downloaded"
+	StatusExpired    Status = "expired"
+	StatusRevoked    Status = "revoked"
+)
 
 type Token struct {
-	ID   []byte    `json:id`
-	T    time.Time `json:t`
-	Name string    `jsoon:name`
+	ID      []byte    `json:"id"`
+	Code    string    `json:"code"`
+	T       time.Time `json:"t"`
+	Expires time.Time `json:"expires"`
+	Kind    Kind      `json:"kind"`
+	Status  Status    `json:"status"`
+
+	Label     string `json:"label"`
+	Recipient string `json:"recipient"`
+	Note      string `json:"note"`
+
+	// ShowNote is set if the note is meant for the recipient. Label,
+	// recipient and a note that is not are only shown to the admin.
+	ShowNote bool `json:"show_note,omitempty"`
+
+	Files    []FileInfo `json:"files"`
+	Uploads  []Partial  `json:"uploads,omitempty"`
+	MaxFiles int        `json:"max_files"`
+	MaxBytes int64      `json:"max_bytes"`
+	MaxSize  int64      `json:"max_size"`
+
+	MaxDownloads int `json:"max_downloads"`
+	Downloads    int `json:"downloads"`
+
+	// Resumes records how far interrupted downloads got, their
+	// continuations are not counted again.
+	Resumes []Resumption `json:"resumes,omitempty"`
+
+	Protected bool   `json:"protected"`
+	Hash      []byte `json:"hash,omitempty"`
+
+	// Owner is the admin who created the token, its files count against
+	// the quota of that admin.
+	Owner string `json:"owner,omitempty"`
+
+	// DataKey is the key the files of the token are encrypted with,
+	// wrapped with the master key KeyID of the server.
+	DataKey []byte `json:"data_key,omitempty"`
+	KeyID   string `json:"key_id,omitempty"`
 }
 
+// Partial describes a resumable upload in progress, of which Offset bytes
+// have been received.
+type Partial struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+
+	// SHA256 is the digest announced by the sender, it is verified once
+	// the upload is complete.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Encrypted is set if the received bytes are stored encrypted.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// E2E is set if the sender encrypted the file, see FileInfo.
+	E2E *E2E `json:"e2e,omitempty"`
+
+	// T is the time the upload was created or last received bytes.
+	T time.Time `json:"t,omitempty"`
+}
+
+// Resumption describes an interrupted download of a file, of which Offset
+// bytes have been sent.
+type Resumption struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+}
+
+// FileInfo describes a single file uploaded to a token.
+type FileInfo struct {
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	T    time.Time `json:"t"`
+
+	// SHA256 is the hex encoded digest of the file, computed by the server
+	// while it was received.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Encoding is the compression the file is stored with, Size and
+	// SHA256 are those of the original file.
+	Encoding string `json:"encoding,omitempty"`
+
+	// Encrypted is set if the file is stored encrypted, with the data key
+	// of the token or of its blob.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// Blob is the digest of the deduplicated content the file refers to,
+	// empty if the file is stored with its token.
+	Blob string `json:"blob,omitempty"`
+
+	// E2E is set if the sender encrypted the file, the server only holds
+	// the ciphertext. Size and SHA256 are those of the ciphertext.
+	E2E *E2E `json:"e2e,omitempty"`
+}
+
+// Usage reports the bytes held by the files and pending uploads of tokens.
+// The bytes are counted as uploaded: a file stored compressed or shared
+// with other tokens by deduplication counts with its full size for each
+// token. A quota of 0 is unlimited.
+type Usage struct {
+	Used  int64 `json:"used"`
+	Quota int64 `json:"quota"`
+
+	// Admin is the admin asking, AdminUsed the bytes held by its tokens.
+	Admin      string `json:"admin"`
+	AdminUsed  int64  `json:"admin_used"`
+	AdminQuota int64  `json:"admin_quota"`
+
+	// Free is the free space of the storage, -1 if it is unknown.
+	Free int64 `json:"free"`
+}
+
+// Archive is the format a token with several files is downloaded in.
+type Archive string
+
 const (
-	ID   = "id"
-	File = "file"
+	ArchiveZip   Archive = "zip"
+	ArchiveTarGz Archive = "tar.gz"
+)
+
+// ManifestName is the name of the manifest added to every archive.
+const ManifestName = "MANIFEST.json"
+
+// ManifestEntry lists a file of an archive with its SHA-256 checksum in hex.
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Key returns the code of the token, the printable form of its ID used in
+// links. Tokens created before codes were introduced fall back to hex.
+func (t Token) Key() string {
+	if t.Code != "" {
+		return t.Code
+	}
+
+	return hex.EncodeToString(t.ID)
+}
+
+// State returns the status of the token. For tokens stored before the
+// status was recorded it is derived from the files and downloads.
+func (t Token) State() Status {
+	switch {
+	case t.Status != "":
+		return t.Status
+	case t.Downloads > 0:
+		return StatusDownloaded
+	case len(t.Files) > 0:
+		return StatusComplete
+	}
+
+	return StatusCreated
+}
+
+// Expired reports whether the token has an expiry that lies before now.
+// Tokens without an expiry never expire.
+func (t Token) Expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// Exhausted reports whether all permitted downloads have been used up.
+func (t Token) Exhausted() bool {
+	return t.MaxDownloads > 0 && t.Downloads >= t.MaxDownloads
+}
+
+// File returns the file called name.
+func (t Token) File(name string) (FileInfo, bool) {
+	for _, f := range t.Files {
+		if f.Name == name {
+			return f, true
+		}
+	}
+
+	return FileInfo{}, false
+}
+
+// Partial returns the resumable upload called name.
+func (t Token) Partial(name string) (Partial, bool) {
+	for _, p := range t.Uploads {
+		if p.Name == name {
+			return p, true
+		}
+	}
+
+	return Partial{}, false
+}
+
+// SetPartial records p, replacing a previous upload of the same name.
+func (t *Token) SetPartial(p Partial) {
+	t.DropPartial(p.Name)
+	t.Uploads = append(t.Uploads, p)
+}
+
+// DropPartial forgets the resumable upload called name.
+func (t *Token) DropPartial(name string) {
+	uploads := t.Uploads[:0]
+	for _, p := range t.Uploads {
+		if p.Name != name {
+			uploads = append(uploads, p)
+		}
+	}
+
+	t.Uploads = uploads
+	if len(t.Uploads) == 0 {
+		t.Uploads = nil
+	}
+}
+
+// Resumption returns the interrupted download of the file called name.
+func (t Token) Resumption(name string) (Resumption, bool) {
+	for _, r := range t.Resumes {
+		if r.Name == name {
+			return r, true
+		}
+	}
+
+	return Resumption{}, false
+}
+
+// SetResumption records r, replacing a previous download of the same file.
+func (t *Token) SetResumption(r Resumption) {
+	t.DropResumption(r.Name)
+	t.Resumes = append(t.Resumes, r)
+}
+
+// DropResumption forgets the interrupted download of the file called name.
+func (t *Token) DropResumption(name string) {
+	resumes := t.Resumes[:0]
+	for _, r := range t.Resumes {
+		if r.Name != name {
+			resumes = append(resumes, r)
+		}
+	}
+
+	t.Resumes = resumes
+	if len(t.Resumes) == 0 {
+		t.Resumes = nil
+	}
+}
+
+// Size returns the total size of all files of the token.
+func (t Token) Size() int64 {
+	var n int64
+	for _, f := range t.Files {
+		n += f.Size
+	}
+
+	return n
+}
+
+// Add records f, replacing a previous file of the same name. It returns
+// TokenFull if f does not fit into the file count or byte limit.
+func (t *Token) Add(f FileInfo) error {
+	files := make([]FileInfo, 0, len(t.Files)+1)
+	for _, g := range t.Files {
+		if g.Name != f.Name {
+			files = append(files, g)
+		}
+	}
+	files = append(files, f)
+
+	if t.MaxFiles > 0 && len(files) > t.MaxFiles {
+		return TokenFull{}
+	}
+
+	next := Token{Files: files}
+	if t.MaxBytes > 0 && next.Size() > t.MaxBytes {
+		return TokenFull{}
+	}
+
+	t.Files = files
+	return nil
+}
+
+const (
+	ID       = "id"
+	File     = "file"
+	Name     = "name"
+	TTL      = "ttl"
+	MaxFiles = "max_files"
+	MaxBytes = "max_bytes"
+	MaxSize  = "max_size"
+
+	MaxDownloads = "max_downloads"
+	Format       = "format"
+	SHA256       = "sha256"
+	Encryption   = "e2e"
+
+	Label     = "label"
+	Recipient = "recipient"
+	Note      = "note"
+	ShowNote  = "show_note"
+
+	// PassphraseHeader carries the passphrase of a protected token. It is
+	// never sent in the query, where it would end up in access logs and
+	// the browser history.
+	PassphraseHeader = "X-Tokenshare-Passphrase"
 
 	ReqList     = "/list"
 	ReqCreate   = "/create"
+	ReqDelete   = "/delete"
+	ReqRevoke   = "/revoke"
 	ReqUpload   = "/upload"
+	ReqShare    = "/share"
+	ReqReceive  = "/receive"
 	ReqSingle   = "/single"
 	ReqTransfer = "/transfer"
 	ReqDownload = "/download"
+	ReqUsage    = "/usage"
+
+	// ReqResumable is the prefix of the tus resumable upload endpoint.
+	ReqResumable = "/resumable/"
+	// ReqPut is the prefix of the plain upload endpoint, files are PUT to
+	// ReqPut + "<id>/<name>".
+	ReqPut = "/t/"
 )
 
 type NoSuchToken struct{}
@@ -25,3 +354,45 @@ type NoSuchToken struct{}
 func (_ NoSuchToken) Error() string {
 	return "no such token"
 }
+
+type TokenExpired struct{}
+
+func (_ TokenExpired) Error() string {
+	return "token expired"
+}
+
+type TokenFull struct{}
+
+func (_ TokenFull) Error() string {
+	return "token full"
+}
+
+type DownloadLimit struct{}
+
+func (_ DownloadLimit) Error() string {
+	return "download limit reached"
+}
+
+type WrongPassphrase struct{}
+
+func (_ WrongPassphrase) Error() string {
+	return "wrong passphrase"
+}
+
+type TokenRevoked struct{}
+
+func (_ TokenRevoked) Error() string {
+	return "token revoked"
+}
+
+type QuotaExceeded struct{}
+
+func (_ QuotaExceeded) Error() string {
+	return "storage quota exceeded"
+}
+
+type ChecksumMismatch struct{}
+
+func (_ ChecksumMismatch) Error() string {
+	return "checksum mismatch"
+}
@@ -9,8 +9,11 @@ import (
 )
 
 var (
-	butUpload  *dom.HTMLButtonElement
-	divMessage *dom.HTMLDivElement
+	butUpload     *dom.HTMLButtonElement
+	divMessage    *dom.HTMLDivElement
+	inpPassphrase *dom.HTMLInputElement
+	inpE2E        *dom.HTMLInputElement
+	pLink         *dom.HTMLParagraphElement
 
 	openResult *tokenshare.OpenResult
 	client     tokenshare.Client
@@ -20,6 +23,9 @@ func main() {
 	d := dom.GetWindow().Document()
 	butUpload = d.GetElementByID("upload").(*dom.HTMLButtonElement)
 	divMessage = d.GetElementByID("message").(*dom.HTMLDivElement)
+	inpPassphrase = d.GetElementByID("passphrase").(*dom.HTMLInputElement)
+	inpE2E = d.GetElementByID("e2e").(*dom.HTMLInputElement)
+	pLink = d.GetElementByID("link").(*dom.HTMLParagraphElement)
 	openResult = &tokenshare.OpenResult{}
 
 	butUpload.Disabled = true
@@ -40,7 +46,12 @@ func main() {
 
 	pTok := d.GetElementByID("token").(*dom.HTMLParagraphElement)
 	tok := token()
-	pTok.SetInnerHTML(fmt.Sprintf("%v %s", tok.T, tok.Name)) // TODO Download
+	if tok.Protected {
+		inpPassphrase.RemoveAttribute("hidden")
+		pTok.SetTextContent(fmt.Sprintf("%v, protected by a passphrase", tok.T))
+		return
+	}
+	pTok.SetTextContent(fmt.Sprintf("%v, %d file(s) uploaded", tok.T, len(tok.Files)))
 }
 
 func message(m string) {
@@ -55,7 +66,7 @@ func token() tokenshare.Token {
 	}
 
 	client := tokenshare.Client{}
-	token, ok, err := client.Single(id)
+	token, ok, err := client.Single(id, "")
 	if err != nil {
 		message(fmt.Sprintf("unable to query token: %v", err))
 	}
@@ -79,10 +90,37 @@ func upload() {
 		log.Println(err)
 	}
 
-	err = client.Upload(res.Data, res.Name, id, divMessage)
+	if !inpE2E.Checked {
+		if err := client.Upload(res.Data, res.Name, id, inpPassphrase.Value, divMessage); err != nil {
+			message(err.Error())
+		}
+		return
+	}
+
+	// all files uploaded from this page share the key in its fragment
+	key, err := client.E2EKey()
 	if err != nil {
 		message(err.Error())
+		return
 	}
+
+	if key == nil {
+		if key, err = tokenshare.NewE2EKey(); err != nil {
+			message(err.Error())
+			return
+		}
+		client.SetE2EKey(key)
+	}
+
+	if err := client.UploadE2E(res.Data, res.Name, id, inpPassphrase.Value, key, divMessage); err != nil {
+		message(err.Error())
+		return
+	}
+
+	// the key never reaches the server, only this link holds it
+	u := client.Url()
+	u.Path = tokenshare.ReqReceive
+	pLink.SetTextContent("The recipient decrypts the files with this link: " + tokenshare.E2ELink(u.String(), key))
 }
 
 func id() (string, error) {